@@ -0,0 +1,361 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/password"
+	"github.com/daniilgaltsev/chirpylike/internal/pubsub"
+)
+
+const chirpsDelete = "delete"
+const chirpsAnonymize = "anonymize"
+
+type exportProfile struct {
+	Id int `json:"id"`
+	Email string `json:"email"`
+	PendingEmail string `json:"pending_email,omitempty"`
+	IsVerified bool `json:"is_verified"`
+	TotpEnabled bool `json:"totp_enabled"`
+	Handle string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Bio string `json:"bio,omitempty"`
+	AvatarUrl string `json:"avatar_url,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type exportSession struct {
+	Id int `json:"id"`
+	IpAddress string `json:"ip_address"`
+	UserAgent string `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type exportLike struct {
+	ChirpId int `json:"chirp_id"`
+	LikedAt time.Time `json:"liked_at"`
+}
+
+type exportFollow struct {
+	UserId int `json:"user_id"`
+	FollowedAt time.Time `json:"followed_at"`
+}
+
+// exportRelation is a user the exporting user blocked or muted
+type exportRelation struct {
+	UserId int `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportMembership struct {
+	IsChirpyRed bool `json:"is_chirpy_red"`
+	Record *database.Membership `json:"record,omitempty"`
+}
+
+// userExport is everything stored about a user, minus secrets like
+// password and token hashes.
+type userExport struct {
+	ExportedAt time.Time `json:"exported_at"`
+	Profile exportProfile `json:"profile"`
+	Chirps []database.Chirp `json:"chirps"`
+	Sessions []exportSession `json:"sessions"`
+	PersonalAccessTokens []responsePersonalAccessToken `json:"personal_access_tokens"`
+	Likes []exportLike `json:"likes"`
+	Following []exportFollow `json:"following"`
+	Followers []exportFollow `json:"followers"`
+	Blocks []exportRelation `json:"blocks"`
+	Mutes []exportRelation `json:"mutes"`
+	Membership exportMembership `json:"membership"`
+}
+
+func buildUserExport(db database.Database, user database.User) userExport {
+	export := userExport{
+		ExportedAt: time.Now().UTC(),
+		Profile: exportProfile{
+			Id: user.Id,
+			Email: user.Email,
+			PendingEmail: user.PendingEmail,
+			IsVerified: user.IsVerified,
+			TotpEnabled: user.TotpEnabled,
+			Handle: user.Handle,
+			DisplayName: user.DisplayName,
+			Bio: user.Bio,
+			AvatarUrl: user.AvatarUrl,
+			CreatedAt: user.CreatedAt,
+			UpdatedAt: user.UpdatedAt,
+		},
+		Chirps: []database.Chirp{},
+		Sessions: []exportSession{},
+		PersonalAccessTokens: []responsePersonalAccessToken{},
+		Likes: []exportLike{},
+		Following: exportFollows(db.Follows[user.Id]),
+		Followers: exportFollows(db.Followers[user.Id]),
+		Blocks: exportRelations(db.Blocks[user.Id]),
+		Mutes: exportRelations(db.Mutes[user.Id]),
+		Membership: exportMembership{
+			IsChirpyRed: user.IsChirpyRed,
+		},
+	}
+
+	for _, chirp := range db.Chirps {
+		if chirp.AuthorId == user.Id {
+			export.Chirps = append(export.Chirps, chirp)
+		}
+	}
+	sort.Slice(export.Chirps, func(i, j int) bool {
+		return export.Chirps[i].Id < export.Chirps[j].Id
+	})
+
+	for _, session := range db.Sessions {
+		if session.UserId == user.Id {
+			export.Sessions = append(export.Sessions, exportSession{
+				Id: session.Id,
+				IpAddress: session.IpAddress,
+				UserAgent: session.UserAgent,
+				CreatedAt: session.CreatedAt,
+				ExpiresAt: session.ExpiresAt,
+				RevokedAt: session.RevokedAt,
+			})
+		}
+	}
+	sort.Slice(export.Sessions, func(i, j int) bool {
+		return export.Sessions[i].Id < export.Sessions[j].Id
+	})
+
+	for _, token := range db.PersonalAccessTokens {
+		if token.UserId == user.Id {
+			export.PersonalAccessTokens = append(export.PersonalAccessTokens, newResponsePersonalAccessToken(token))
+		}
+	}
+	sort.Slice(export.PersonalAccessTokens, func(i, j int) bool {
+		return export.PersonalAccessTokens[i].Id < export.PersonalAccessTokens[j].Id
+	})
+
+	for chirpId, likes := range db.ChirpLikes {
+		likedAt, ok := likes[user.Id]
+		if ok {
+			export.Likes = append(export.Likes, exportLike{
+				ChirpId: chirpId,
+				LikedAt: likedAt,
+			})
+		}
+	}
+	sort.Slice(export.Likes, func(i, j int) bool {
+		return export.Likes[i].LikedAt.Before(export.Likes[j].LikedAt)
+	})
+
+	membership, ok := db.Memberships[user.Id]
+	if ok {
+		export.Membership.Record = &membership
+	}
+
+	return export
+}
+
+func exportFollows(follows map[int]time.Time) []exportFollow {
+	export := []exportFollow{}
+	for userId, followedAt := range follows {
+		export = append(export, exportFollow{
+			UserId: userId,
+			FollowedAt: followedAt,
+		})
+	}
+	sort.Slice(export, func(i, j int) bool {
+		return export[i].FollowedAt.Before(export[j].FollowedAt)
+	})
+	return export
+}
+
+func exportRelations(relations map[int]time.Time) []exportRelation {
+	export := []exportRelation{}
+	for userId, createdAt := range relations {
+		export = append(export, exportRelation{
+			UserId: userId,
+			CreatedAt: createdAt,
+		})
+	}
+	sort.Slice(export, func(i, j int) bool {
+		return export[i].CreatedAt.Before(export[j].CreatedAt)
+	})
+	return export
+}
+
+// writeUserExportZip writes one json file per section of the export
+func writeUserExportZip(w http.ResponseWriter, export userExport) error {
+	files := []struct {
+		name string
+		content interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"chirps.json", export.Chirps},
+		{"sessions.json", export.Sessions},
+		{"personal_access_tokens.json", export.PersonalAccessTokens},
+		{"likes.json", export.Likes},
+		{"following.json", export.Following},
+		{"followers.json", export.Followers},
+		{"blocks.json", export.Blocks},
+		{"mutes.json", export.Mutes},
+		{"membership.json", export.Membership},
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d.zip"`, export.Profile.Id))
+	w.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		dat, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			return err
+		}
+		writer, err := archive.CreateHeader(&zip.FileHeader{
+			Name: file.name,
+			Method: zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(dat)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+
+func handleUsersExportGet(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		chirpsRespondWithJsonError(w, "Format must be json or zip")
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user, ok := db.Users[p.User.Id]
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	export := buildUserExport(db, user)
+
+	if format == "zip" {
+		err = writeUserExportZip(w, export)
+		if err != nil {
+			// Headers are already sent, all that's left is to cut the archive short
+			fmt.Println("Error writing export archive:", err)
+		}
+		return
+	}
+
+	dat, err := json.Marshal(export)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d.json"`, user.Id))
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+// handleUsersDelete deletes the caller's account. The password, and the
+// second factor if enabled, must be given again even with a valid token.
+func handleUsersDelete(w http.ResponseWriter, r *http.Request, guard *loginGuard, hasher *password.Hasher, events *pubsub.Bus[streamEvent]) {
+	type requestDelete struct {
+		Password string `json:"password"`
+		Chirps string `json:"chirps"`
+		requestSecondFactor
+	}
+
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body requestDelete
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil || body.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body.Chirps != chirpsDelete && body.Chirps != chirpsAnonymize {
+		chirpsRespondWithJsonError(w, `Chirps must be "delete" or "anonymize"`)
+		return
+	}
+
+	ip := clientIp(r)
+	wait := guard.lockedFor(p.User.Email, ip)
+	if wait > 0 {
+		respondWithLoginLocked(w, wait)
+		return
+	}
+
+	equal, _, err := hasher.Verify(p.User.Password, body.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !equal {
+		guard.fail(p.User.Email, ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if p.User.TotpEnabled {
+		err = verifySecondFactor(p.User, body.requestSecondFactor)
+		if errors.Is(err, errSecondFactorInvalid) {
+			guard.fail(p.User.Email, ip)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Taken before the chirps are gone, for the authors of the events
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	removed, err := database.DeleteUser(p.User.Id, body.Chirps == chirpsAnonymize)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	emitChirpsDeleted(events, db, removed)
+
+	guard.succeed(p.User.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+type principal struct {
+	User database.User
+	// TokenId is the personal access token the request was made with,
+	// zero for a regular login session.
+	TokenId int
+	Scopes []string
+	// ExpiresAt is when the credentials stop being accepted, zero if they
+	// don't expire
+	ExpiresAt time.Time
+}
+
+func (p principal) isSession() bool {
+	return p.TokenId == 0
+}
+
+func (p principal) hasScope(scope string) bool {
+	if p.isSession() {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
+var errMissingAuthorization = errors.New("missing authorization header")
+var errUnauthorized = errors.New("unauthorized")
+
+
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalContextKey).(principal)
+	return p, ok
+}
+
+func withPrincipal(ctx context.Context, p principal) context.Context {
+	return context.WithValue(ctx, principalContextKey, p)
+}
+
+// authenticate resolves the principal behind the Authorization header.
+// Access tokens and personal access tokens are accepted, refresh tokens
+// have their own endpoints.
+// Returns errMissingAuthorization when there is no header at all and
+// errUnauthorized when the credentials are present but not acceptable.
+func authenticate(r *http.Request, jwtSecret string) (principal, error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return principal{}, errMissingAuthorization
+	}
+
+	return authenticateAuthorization(authorization, jwtSecret)
+}
+
+// authenticateAuthorization resolves the principal behind an Authorization
+// header value, for credentials that don't arrive in the header
+func authenticateAuthorization(authorization, jwtSecret string) (principal, error) {
+	if isPersonalAccessToken(authorization) {
+		return authenticatePersonalAccessToken(authorization)
+	}
+
+	_, claims, err := parseAuthorization(authorization, jwtSecret)
+	if err != nil {
+		return principal{}, errUnauthorized
+	}
+
+	issuer, err := claims.GetIssuer()
+	if err != nil || issuer != issuerAccess {
+		return principal{}, errUnauthorized
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return principal{}, errUnauthorized
+	}
+	id, err := strconv.Atoi(subject)
+	if err != nil {
+		return principal{}, errUnauthorized
+	}
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return principal{}, errUnauthorized
+	}
+
+	user, err := database.GetUser(id)
+	if errors.Is(err, database.ErrUserNotFound) {
+		return principal{}, errUnauthorized
+	}
+	if err != nil {
+		return principal{}, err
+	}
+
+	return principal{User: user, ExpiresAt: expiresAt.Time}, nil
+}
+
+func authenticatePersonalAccessToken(authorization string) (principal, error) {
+	tokenString := strings.TrimPrefix(authorization, "Bearer ")
+	token, err := database.GetPersonalAccessTokenByHash(hashToken(tokenString))
+	if errors.Is(err, database.ErrTokenNotFound) {
+		return principal{}, errUnauthorized
+	}
+	if err != nil {
+		return principal{}, err
+	}
+
+	if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+		return principal{}, errUnauthorized
+	}
+
+	user, err := database.GetUser(token.UserId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		return principal{}, errUnauthorized
+	}
+	if err != nil {
+		return principal{}, err
+	}
+
+	p := principal{User: user, TokenId: token.Id, Scopes: token.Scopes}
+	if token.ExpiresAt != nil {
+		p.ExpiresAt = *token.ExpiresAt
+	}
+	return p, nil
+}
+
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errMissingAuthorization) || errors.Is(err, errUnauthorized) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// middlewareRequireAuth rejects requests without valid credentials with 401.
+func (cfg *apiConfig) middlewareRequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(r, cfg.jwtSecret)
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// middlewareOptionalAuth lets anonymous requests through, but still rejects
+// invalid credentials instead of silently treating the caller as anonymous.
+func (cfg *apiConfig) middlewareOptionalAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(r, cfg.jwtSecret)
+		if errors.Is(err, errMissingAuthorization) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// requireScope rejects personal access tokens that were not granted scope.
+// Requests without a principal are left to the auth middleware before it.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := principalFromContext(r.Context())
+			if ok && !p.hasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireSession rejects personal access tokens, for endpoints that must
+// only be reachable from a login session.
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := principalFromContext(r.Context())
+		if ok && !p.isSession() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middlewareAdminAuth protects admin endpoints that expose user data with
+// an "ApiKey <key>" header. Without ADMIN_API_KEY configured they are disabled.
+func (cfg *apiConfig) middlewareAdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.adminApiKey == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		authorization := r.Header.Get("Authorization")
+		apiKey, found := strings.CutPrefix(authorization, "ApiKey ")
+		if !found || subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminApiKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", "ApiKey")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
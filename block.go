@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+type responseRelation struct {
+	User authorSummary `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func handleUsersBlockPut(w http.ResponseWriter, r *http.Request) {
+	handleUsersRelationChange(w, r, database.BlockUser)
+}
+
+func handleUsersBlockDelete(w http.ResponseWriter, r *http.Request) {
+	handleUsersRelationChange(w, r, database.UnblockUser)
+}
+
+func handleUsersMutePut(w http.ResponseWriter, r *http.Request) {
+	handleUsersRelationChange(w, r, database.MuteUser)
+}
+
+func handleUsersMuteDelete(w http.ResponseWriter, r *http.Request) {
+	handleUsersRelationChange(w, r, database.UnmuteUser)
+}
+
+// handleUsersRelationChange applies change from the caller to the user in
+// the route. Changes are idempotent.
+func handleUsersRelationChange(w http.ResponseWriter, r *http.Request, change func(fromId, toId int) error) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user, ok := findUserByRef(db, chi.URLParam(r, "user"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = change(p.User.Id, user.Id)
+	if errors.Is(err, database.ErrRelationSelf) {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleBlocksGet(w http.ResponseWriter, r *http.Request) {
+	handleRelationsGet(w, r, func(db database.Database, userId int) map[int]time.Time {
+		return db.Blocks[userId]
+	})
+}
+
+func handleMutesGet(w http.ResponseWriter, r *http.Request) {
+	handleRelationsGet(w, r, func(db database.Database, userId int) map[int]time.Time {
+		return db.Mutes[userId]
+	})
+}
+
+// handleRelationsGet lists the users the caller blocked or muted, newest
+// first. Only the caller gets to see these.
+func handleRelationsGet(w http.ResponseWriter, r *http.Request, relations func(db database.Database, userId int) map[int]time.Time) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	users := []responseRelation{}
+	for userId, createdAt := range relations(db, p.User.Id) {
+		user, ok := db.Users[userId]
+		if ok {
+			users = append(users, responseRelation{
+				User: newAuthorSummary(user),
+				CreatedAt: createdAt,
+			})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.After(users[j].CreatedAt)
+	})
+
+	dat, err := json.Marshal(users)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
 	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/pubsub"
 )
 
 func chirpsRespondWithInternalError(w http.ResponseWriter) {
@@ -25,71 +30,128 @@ func chirpsRespondWithNotFoundError(w http.ResponseWriter) {
 
 
 func chirpsRespondWithJsonError(w http.ResponseWriter, e string) {
-	type responseError struct {
-		Error string `json:"error"`
-	}
+	respondWithJsonError(w, e, http.StatusBadRequest)
+}
 
-	response := responseError{Error: e}
-	dat, err := json.Marshal(response)
-	if err != nil {
-		chirpsRespondWithInternalError(w)
-		return
-	}
+// chirpPostError is why a chirp was not posted, with the status to answer
+// with
+type chirpPostError struct {
+	status int
+	message string
+	// retryAfter is how long until the author may post again, set with
+	// http.StatusTooManyRequests
+	retryAfter time.Duration
+}
 
-	respondWithJson(w, dat, http.StatusBadRequest)
+func (e *chirpPostError) Error() string {
+	return e.message
 }
 
-func handleChirpsPost(w http.ResponseWriter, r *http.Request, jwtSecret string) {
-	_, claims, err := parseAuthorization(r.Header.Get("Authorization"), jwtSecret)
-	if err != nil {
-		chirpsRespondWithBadRequestError(w)
+func respondWithChirpPostError(w http.ResponseWriter, err *chirpPostError) {
+	if err.status == http.StatusTooManyRequests {
+		respondWithChirpRateLimited(w, err.retryAfter)
 		return
 	}
+	respondWithJsonError(w, err.message, err.status)
+}
+
+// createChirp checks and saves a chirp posted by author, then announces it
+// to webhooks, live streams and the users it notifies. It is shared by
+// POST /api/chirps and the WebSocket API. Errors meant for the client are
+// *chirpPostError.
+func (cfg *apiConfig) createChirp(author database.User, request chirp) (database.Chirp, database.Database, error) {
+	if cfg.requireVerifiedEmail && !author.IsVerified {
+		return database.Chirp{}, database.Database{}, &chirpPostError{status: http.StatusForbidden, message: "Email address is not verified"}
+	}
 
-	issuer, err := claims.GetIssuer()
+	allowed := cfg.entitlements.forUser(author)
+	chirpBody, err := validateChirpBody(request.Chirp, allowed.MaxChirpLength)
 	if err != nil {
-		chirpsRespondWithInternalError(w)
-		return
+		return database.Chirp{}, database.Database{}, &chirpPostError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	err = validateAttachments(request.Attachments, allowed.MaxAttachments)
+	if err != nil {
+		return database.Chirp{}, database.Database{}, &chirpPostError{status: http.StatusBadRequest, message: err.Error()}
 	}
 
-	if issuer != issuerAccess {
-		chirpsRespondWithBadRequestError(w)
-		return
+	ok, wait := cfg.chirpLimiter.allow(author.Id, allowed.ChirpsPerHour, time.Now())
+	if !ok {
+		return database.Chirp{}, database.Database{}, &chirpPostError{status: http.StatusTooManyRequests, message: "Too many chirps, try again later", retryAfter: wait}
 	}
 
-	subject, err := claims.GetSubject()
+	chirp, err := database.SaveChirp(database.ChirpDraft{
+		Body: chirpBody,
+		AuthorId: author.Id,
+		Attachments: request.Attachments,
+		InReplyToId: request.InReplyTo,
+		RechirpOfId: request.RechirpOf,
+		QuoteOfId: request.QuoteOf,
+	})
+	if errors.Is(err, database.ErrChirpNotFound) {
+		return database.Chirp{}, database.Database{}, &chirpPostError{status: http.StatusBadRequest, message: "Chirp being replied to, rechirped or quoted does not exist"}
+	}
+	if errors.Is(err, database.ErrChirpDeleted) {
+		return database.Chirp{}, database.Database{}, &chirpPostError{status: http.StatusBadRequest, message: "Chirp being replied to, rechirped or quoted was deleted"}
+	}
+	if errors.Is(err, database.ErrBlocked) {
+		return database.Chirp{}, database.Database{}, &chirpPostError{status: http.StatusForbidden, message: err.Error()}
+	}
+	if errors.Is(err, database.ErrAlreadyRechirped) {
+		return database.Chirp{}, database.Database{}, &chirpPostError{status: http.StatusConflict, message: "Chirp was already rechirped"}
+	}
 	if err != nil {
-		chirpsRespondWithInternalError(w) // TODO: definitely should fix all the errors to be consistent
-		return
+		return database.Chirp{}, database.Database{}, err
 	}
-	id, err := strconv.Atoi(subject)
+
+	db, err := database.GetDB()
 	if err != nil {
-		chirpsRespondWithInternalError(w)
+		return database.Chirp{}, database.Database{}, err
+	}
+
+	created := newResponseChirp(db, chirp, chirpView{})
+	emitWebhookEvent(webhookEventChirpCreated, created)
+	publishStreamEvent(cfg.chirpEvents, db, streamEventChirpCreated, chirp, created)
+	notifyChirpCreated(cfg.notifications, db, chirp)
+
+	return chirp, db, nil
+}
+
+func (cfg *apiConfig) handleChirpsPost(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
+	view, err := parseChirpView(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
 
-	chirpBody, err := decodeChirp(r)
+	request, err := decodeChirp(r)
 
+	if errors.Is(err, errRechirpWithContent) {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
 	if err != nil {
 		chirpsRespondWithJsonError(w, "Something went wrong")
 		return
 	}
 
-	if len(chirpBody) > 140 {
-		chirpsRespondWithJsonError(w, "Chirp is too long")
+	chirp, db, err := cfg.createChirp(p.User, request)
+	var postErr *chirpPostError
+	if errors.As(err, &postErr) {
+		respondWithChirpPostError(w, postErr)
 		return
 	}
-
-	chirpBody = cleanChirp(chirpBody)
-
-	chirp, err := database.SaveChirp(chirpBody, id)
 	if err != nil {
 		chirpsRespondWithInternalError(w)
 		return
 	}
 
-	dat, err := json.Marshal(chirp)
+	dat, err := json.Marshal(newResponseChirp(db, chirp, view))
 	if err != nil {
 		chirpsRespondWithInternalError(w)
 		return
@@ -99,7 +161,13 @@ func handleChirpsPost(w http.ResponseWriter, r *http.Request, jwtSecret string)
 }
 
 
-func handleChirpsDeleteId(w http.ResponseWriter, r *http.Request, jwtSecret string) {
+func handleChirpsDeleteId(w http.ResponseWriter, r *http.Request, events *pubsub.Bus[streamEvent]) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	db, err := database.GetDB()
 
 	if err != nil {
@@ -115,45 +183,234 @@ func handleChirpsDeleteId(w http.ResponseWriter, r *http.Request, jwtSecret stri
 	}
 	
 	chirp, ok := db.Chirps[id]
-	if !ok {
+	if !ok || chirp.DeletedAt != nil {
 		chirpsRespondWithNotFoundError(w)
 		return
 	}
 
-	chirpAuthor := chirp.AuthorId
-
-	_, claims, err := parseAuthorization(r.Header.Get("Authorization"), jwtSecret)
-	if err != nil {
-		chirpsRespondWithBadRequestError(w)
+	if p.User.Id != chirp.AuthorId {
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	subject, err := claims.GetSubject()
-	if err != nil {
-		chirpsRespondWithInternalError(w)
+	removed, err := database.DeleteChirp(id)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		chirpsRespondWithNotFoundError(w)
 		return
 	}
-
-	userId, err := strconv.Atoi(subject)
 	if err != nil {
 		chirpsRespondWithInternalError(w)
 		return
 	}
 
-	if userId != chirpAuthor {
-		w.WriteHeader(http.StatusForbidden)
-		return
+	emitChirpsDeleted(events, db, removed)
+}
+
+// emitChirpsDeleted sends chirp.deleted events for the removed chirps, db
+// is a snapshot from before they were removed
+func emitChirpsDeleted(events *pubsub.Bus[streamEvent], db database.Database, removed []int) {
+	deletedAt := time.Now().UTC()
+	for _, chirpId := range removed {
+		chirp := db.Chirps[chirpId]
+		deleted := deletedChirpEvent{
+			Id: chirpId,
+			AuthorId: chirp.AuthorId,
+			DeletedAt: deletedAt,
+		}
+		emitWebhookEvent(webhookEventChirpDeleted, deleted)
+		publishStreamEvent(events, db, streamEventChirpDeleted, chirp, deleted)
+	}
+}
+
+
+const chirpSortId = "id"
+const chirpSortCreatedAt = "created_at"
+
+// chirpOrder is the sort order of a chirp listing, ties are broken by id
+type chirpOrder struct {
+	field string
+	descending bool
+}
+
+// parseChirpOrder reads the sort parameter, a field optionally followed by
+// :asc or :desc. The field defaults to id and the direction to ascending,
+// so the plain "asc" and "desc" keep sorting by id.
+func parseChirpOrder(sortStr string) (chirpOrder, error) {
+	order := chirpOrder{field: chirpSortId}
+	if sortStr == "" {
+		return order, nil
+	}
+
+	field, direction, hasDirection := strings.Cut(sortStr, ":")
+	if !hasDirection && (field == "asc" || field == "desc") {
+		field, direction = "", field
+	}
+
+	switch field {
+	case "", chirpSortId:
+	case chirpSortCreatedAt:
+		order.field = chirpSortCreatedAt
+	default:
+		return order, errors.New("sort must be id or created_at, optionally followed by :asc or :desc")
+	}
+
+	switch direction {
+	case "", "asc":
+	case "desc":
+		order.descending = true
+	default:
+		return order, errors.New("sort direction must be asc or desc")
+	}
+	return order, nil
+}
+
+func (o chirpOrder) String() string {
+	if o.descending {
+		return o.field + ":desc"
 	}
+	return o.field + ":asc"
+}
+
+func (o chirpOrder) key(chirp database.Chirp) int64 {
+	if o.field == chirpSortCreatedAt {
+		return chirp.CreatedAt.UnixNano()
+	}
+	return int64(chirp.Id)
+}
 
-	err = database.DeleteChirp(id)
+// compare returns a negative number if a chirp with key and id comes
+// before one with otherKey and otherId in this order.
+func (o chirpOrder) compare(key int64, id int, otherKey int64, otherId int) int {
+	result := 0
+	if key != otherKey {
+		result = -1
+		if key > otherKey {
+			result = 1
+		}
+	} else if id != otherId {
+		result = -1
+		if id > otherId {
+			result = 1
+		}
+	}
+	if o.descending {
+		return -result
+	}
+	return result
+}
+
+func (o chirpOrder) sort(chirps []database.Chirp) {
+	sort.Slice(chirps, func(i, j int) bool {
+		return o.compare(o.key(chirps[i]), chirps[i].Id, o.key(chirps[j]), chirps[j].Id) < 0
+	})
+}
+
+// chirpFilter narrows a chirp listing, zero fields don't filter
+type chirpFilter struct {
+	authorId int
+	filterByAuthor bool
+	sinceId int
+	maxId int
+	// since is inclusive and until exclusive
+	since time.Time
+	until time.Time
+}
+
+// parseTimeParam reads an RFC 3339 timestamp or a plain date, which is
+// taken as midnight UTC.
+func parseTimeParam(name, raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse(time.DateOnly, raw)
+	if err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp or a YYYY-MM-DD date", name)
+}
+
+func parseChirpFilter(r *http.Request, page pageParams) (chirpFilter, error) {
+	query := r.URL.Query()
+	filter := chirpFilter{
+		sinceId: page.sinceId,
+		maxId: page.maxId,
+	}
+
+	authorId, err := strconv.Atoi(query.Get("author_id"))
+	if err == nil {
+		filter.authorId = authorId
+		filter.filterByAuthor = true
+	}
+
+	filter.since, err = parseTimeParam("since", query.Get("since"))
 	if err != nil {
-		chirpsRespondWithInternalError(w)
-		return
+		return filter, err
+	}
+	filter.until, err = parseTimeParam("until", query.Get("until"))
+	if err != nil {
+		return filter, err
 	}
+	return filter, nil
 }
 
+func (f chirpFilter) matches(chirp database.Chirp) bool {
+	if chirp.DeletedAt != nil {
+		return false
+	}
+	if f.filterByAuthor && chirp.AuthorId != f.authorId {
+		return false
+	}
+	if f.sinceId != 0 && chirp.Id <= f.sinceId {
+		return false
+	}
+	if f.maxId != 0 && chirp.Id > f.maxId {
+		return false
+	}
+	if !f.since.IsZero() && chirp.CreatedAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !chirp.CreatedAt.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// paginateChirps returns the page of sorted chirps after the cursor and the
+// cursor for the next page, empty if this is the last one. Since the cursor
+// holds the last sort key rather than an offset, chirps added or deleted in
+// the meantime don't shift later pages.
+func paginateChirps(chirps []database.Chirp, order chirpOrder, page pageParams) ([]database.Chirp, string) {
+	start := 0
+	if page.cursor != nil {
+		start = sort.Search(len(chirps), func(i int) bool {
+			return order.compare(order.key(chirps[i]), chirps[i].Id, page.cursor.Key, page.cursor.Id) > 0
+		})
+	}
+
+	end := start + page.limit
+	if end >= len(chirps) {
+		return chirps[start:], ""
+	}
+
+	last := chirps[end-1]
+	next := encodeCursor(pageCursor{
+		Order: order.String(),
+		Key: order.key(last),
+		Id: last.Id,
+	})
+	return chirps[start:end], next
+}
 
 func handleChirpsGet(w http.ResponseWriter, r *http.Request) {
+	type responsePage struct {
+		Chirps []responseChirp `json:"chirps"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
 	db, err := database.GetDB()
 
 	if err != nil {
@@ -161,36 +418,65 @@ func handleChirpsGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authorIdStr := r.URL.Query().Get("author_id")
-	authorId, err := strconv.Atoi(authorIdStr)
+	view, err := parseChirpView(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
 
-	ascending := true
-	sortStr := r.URL.Query().Get("sort")
-	if sortStr == "desc" {
-		ascending = false
-	} else if sortStr != "asc" {
-		chirpsRespondWithBadRequestError(w)
+	page, err := parsePageParams(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
 		return
 	}
 
+	order, err := parseChirpOrder(r.URL.Query().Get("sort"))
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	if page.cursor != nil && page.cursor.Order != order.String() {
+		chirpsRespondWithJsonError(w, "cursor was made for a different sort")
+		return
+	}
 
+	filter, err := parseChirpFilter(r, page)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	policy := newChirpPolicy(db, view)
 	chirps := make([]database.Chirp, 0, len(db.Chirps))
 	for _, chirp := range db.Chirps {
-		if err != nil || chirp.AuthorId == authorId {
+		if filter.matches(chirp) && policy.inFeed(chirp) {
 			chirps = append(chirps, chirp)
 		}
 	}
-	if ascending {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].Id < chirps[j].Id
-		})
-	} else {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].Id > chirps[j].Id
-		})
+	order.sort(chirps)
+
+	if !page.paginated {
+		dat, err := json.Marshal(newResponseChirps(db, chirps, view))
+		if err != nil {
+			chirpsRespondWithInternalError(w)
+			return
+		}
+
+		respondWithJson(w, dat, http.StatusOK)
+		return
+	}
+
+	chirps, nextCursor := paginateChirps(chirps, order, page)
+	if nextCursor != "" {
+		setNextLinkHeader(w, r, nextCursor)
+	}
+
+	response := responsePage{
+		Chirps: newResponseChirps(db, chirps, view),
+		NextCursor: nextCursor,
 	}
 
-	dat, err := json.Marshal(chirps)
+	dat, err := json.Marshal(response)
 	if err != nil {
 		chirpsRespondWithInternalError(w)
 		return
@@ -207,6 +493,12 @@ func handleChirpsGetId(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	view, err := parseChirpView(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
 	strId := chi.URLParam(r, "id")
 	id, err := strconv.Atoi(strId)
 	if err != nil {
@@ -215,12 +507,12 @@ func handleChirpsGetId(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	chirp, ok := db.Chirps[id]
-	if !ok {
+	if !ok || chirp.DeletedAt != nil || !newChirpPolicy(db, view).canSee(chirp) {
 		chirpsRespondWithNotFoundError(w)
 		return
 	}
 
-	dat, err := json.Marshal(chirp)
+	dat, err := json.Marshal(newResponseChirp(db, chirp, view))
 	if err != nil {
 		chirpsRespondWithInternalError(w)
 		return
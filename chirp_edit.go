@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+const defaultChirpEditWindow = 30 * time.Minute
+
+// handleChirpsPatch lets the author change the body of a chirp within
+// editWindow of posting it, if their membership includes editing.
+func handleChirpsPatch(w http.ResponseWriter, r *http.Request, editWindow time.Duration, tiers entitlementTiers) {
+	type requestEdit struct {
+		Body string `json:"body"`
+	}
+
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	view, err := parseChirpView(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		chirpsRespondWithBadRequestError(w)
+		return
+	}
+
+	allowed := tiers.forUser(p.User)
+	if !allowed.CanEditChirps {
+		respondWithJsonError(w, "Editing chirps needs Chirpy Red", http.StatusForbidden)
+		return
+	}
+
+	var body requestEdit
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&body)
+	if err != nil || body.Body == "" {
+		chirpsRespondWithJsonError(w, "Chirp is empty")
+		return
+	}
+
+	chirpBody, err := validateChirpBody(body.Body, allowed.MaxChirpLength)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	chirp, ok := db.Chirps[id]
+	if !ok || chirp.DeletedAt != nil {
+		chirpsRespondWithNotFoundError(w)
+		return
+	}
+	if p.User.Id != chirp.AuthorId {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if chirp.RechirpOfId != 0 {
+		chirpsRespondWithJsonError(w, "Rechirps can't be edited")
+		return
+	}
+	if time.Since(chirp.CreatedAt) > editWindow {
+		respondWithJsonError(w, fmt.Sprintf("Chirps can only be edited within %s of posting", editWindow), http.StatusForbidden)
+		return
+	}
+
+	chirp, err = database.EditChirp(id, chirpBody)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		chirpsRespondWithNotFoundError(w)
+		return
+	}
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	db, err = database.GetDB()
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	dat, err := json.Marshal(newResponseChirp(db, chirp, view))
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+// handleChirpsRevisionsGet lists the previous bodies of a chirp, oldest
+// first
+func handleChirpsRevisionsGet(w http.ResponseWriter, r *http.Request) {
+	view, err := parseChirpView(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		chirpsRespondWithBadRequestError(w)
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	chirp, ok := db.Chirps[id]
+	if !ok || chirp.DeletedAt != nil || !newChirpPolicy(db, view).canSee(chirp) {
+		chirpsRespondWithNotFoundError(w)
+		return
+	}
+
+	revisions := db.ChirpRevisions[id]
+	if revisions == nil {
+		revisions = []database.ChirpRevision{}
+	}
+
+	dat, err := json.Marshal(revisions)
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
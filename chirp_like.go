@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/pubsub"
+)
+
+// likesOrder is the only order of like listings, newest first
+const likesOrder = "liked_at:desc"
+
+type responseLikeState struct {
+	LikeCount int `json:"like_count"`
+	LikedByMe bool `json:"liked_by_me"`
+}
+
+type responseLike struct {
+	User authorSummary `json:"user"`
+	LikedAt time.Time `json:"liked_at"`
+}
+
+func handleChirpsLikesPut(w http.ResponseWriter, r *http.Request, notifications *pubsub.Bus[notificationEvent]) {
+	handleChirpsLikeChange(w, r, true, notifications)
+}
+
+func handleChirpsLikesDelete(w http.ResponseWriter, r *http.Request) {
+	handleChirpsLikeChange(w, r, false, nil)
+}
+
+// handleChirpsLikeChange likes or unlikes a chirp for the caller. Both are
+// idempotent and answer with the resulting state. New likes notify the
+// author of the chirp.
+func handleChirpsLikeChange(w http.ResponseWriter, r *http.Request, like bool, notifications *pubsub.Bus[notificationEvent]) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		chirpsRespondWithBadRequestError(w)
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+	_, alreadyLiked := db.ChirpLikes[id][p.User.Id]
+
+	var count int
+	if like {
+		count, err = database.LikeChirp(id, p.User.Id)
+	} else {
+		count, err = database.UnlikeChirp(id, p.User.Id)
+	}
+	if errors.Is(err, database.ErrChirpNotFound) {
+		chirpsRespondWithNotFoundError(w)
+		return
+	}
+	if errors.Is(err, database.ErrBlocked) {
+		respondWithJsonError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	if like && !alreadyLiked {
+		notify(notifications, db, db.Chirps[id].AuthorId, p.User.Id, notification{
+			Kind: notificationLike,
+			ChirpId: id,
+		})
+	}
+
+	dat, err := json.Marshal(responseLikeState{
+		LikeCount: count,
+		LikedByMe: like,
+	})
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+// handleChirpsLikesGet lists the users who liked a chirp, newest like first
+func handleChirpsLikesGet(w http.ResponseWriter, r *http.Request) {
+	type responseLikes struct {
+		Likes []responseLike `json:"likes"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	view, err := parseChirpView(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	if page.cursor != nil && page.cursor.Order != likesOrder {
+		chirpsRespondWithJsonError(w, "cursor was made for a different sort")
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		chirpsRespondWithBadRequestError(w)
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	chirp, ok := db.Chirps[id]
+	if !ok || chirp.DeletedAt != nil || !newChirpPolicy(db, view).canSee(chirp) {
+		chirpsRespondWithNotFoundError(w)
+		return
+	}
+
+	likes := []responseLike{}
+	for userId, likedAt := range db.ChirpLikes[id] {
+		user, ok := db.Users[userId]
+		if !ok {
+			continue
+		}
+		if page.cursor != nil && !newestFirstAfter(likedAt, userId, page.cursor.Key, page.cursor.Id) {
+			continue
+		}
+		likes = append(likes, responseLike{
+			User: newAuthorSummary(user),
+			LikedAt: likedAt,
+		})
+	}
+	sort.Slice(likes, func(i, j int) bool {
+		return newestFirstAfter(likes[j].LikedAt, likes[j].User.Id, likes[i].LikedAt.UnixNano(), likes[i].User.Id)
+	})
+
+	nextCursor := ""
+	if len(likes) > page.limit {
+		likes = likes[:page.limit]
+		last := likes[len(likes)-1]
+		nextCursor = encodeCursor(pageCursor{
+			Order: likesOrder,
+			Key: last.LikedAt.UnixNano(),
+			Id: last.User.Id,
+		})
+		setNextLinkHeader(w, r, nextCursor)
+	}
+
+	dat, err := json.Marshal(responseLikes{
+		Likes: likes,
+		NextCursor: nextCursor,
+	})
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const chirpRateWindow = time.Hour
+
+// chirpRateLimiter counts the chirps each user posted in the last
+// chirpRateWindow. The limit is passed per call since it depends on the
+// user's membership.
+type chirpRateLimiter struct {
+	lock sync.Mutex
+	posts map[int][]time.Time
+}
+
+func newChirpRateLimiter() *chirpRateLimiter {
+	return &chirpRateLimiter{
+		posts: map[int][]time.Time{},
+	}
+}
+
+// allow records a post by the user if they are under limit. Otherwise it
+// returns how long until they can post again.
+func (l *chirpRateLimiter) allow(userId, limit int, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	posts := l.posts[userId]
+	recent := posts[:0]
+	for _, postedAt := range posts {
+		if now.Sub(postedAt) < chirpRateWindow {
+			recent = append(recent, postedAt)
+		}
+	}
+
+	if len(recent) < limit {
+		l.posts[userId] = append(recent, now)
+		return true, 0
+	}
+
+	l.posts[userId] = recent
+	if limit == 0 {
+		return false, chirpRateWindow
+	}
+	return false, recent[len(recent)-limit].Add(chirpRateWindow).Sub(now)
+}
+
+func respondWithChirpRateLimited(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithJsonError(w, "Too many chirps, try again later", http.StatusTooManyRequests)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+// chirpView is how chirps should be rendered for a request
+type chirpView struct {
+	expandAuthor bool
+	// viewerId is the authenticated user, zero for anonymous requests
+	viewerId int
+	// embedded is set while rendering a chirp inside another one
+	embedded bool
+}
+
+type responseChirp struct {
+	Id int `json:"id"`
+	Body string `json:"body"`
+	AuthorId int `json:"author_id"`
+	Author *authorSummary `json:"author,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+	InReplyToId int `json:"in_reply_to_id,omitempty"`
+	RootId int `json:"root_id,omitempty"`
+	ReplyCount int `json:"reply_count"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Deleted marks a tombstone, which has no body or author
+	Deleted bool `json:"deleted,omitempty"`
+	// Hidden marks a chirp kept in a thread for its replies, but whose
+	// content the viewer isn't allowed to see
+	Hidden bool `json:"hidden,omitempty"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	LikeCount int `json:"like_count"`
+	// LikedByMe is only set for authenticated requests
+	LikedByMe *bool `json:"liked_by_me,omitempty"`
+	RechirpOfId int `json:"rechirp_of_id,omitempty"`
+	RechirpOf *responseEmbeddedChirp `json:"rechirp_of,omitempty"`
+	QuoteOfId int `json:"quote_of_id,omitempty"`
+	QuoteOf *responseEmbeddedChirp `json:"quote_of,omitempty"`
+	RechirpCount int `json:"rechirp_count"`
+	QuoteCount int `json:"quote_count"`
+}
+
+// responseEmbeddedChirp is a chirp shown inside a rechirp or quote. Once
+// the original is deleted only its id is left.
+type responseEmbeddedChirp struct {
+	Id int `json:"id"`
+	Unavailable bool `json:"unavailable,omitempty"`
+	*responseChirp
+}
+
+// parseChirpView reads the comma separated expand parameter and who is
+// asking.
+func parseChirpView(r *http.Request) (chirpView, error) {
+	view := chirpView{}
+
+	p, ok := principalFromContext(r.Context())
+	if ok {
+		view.viewerId = p.User.Id
+	}
+
+	expand := r.URL.Query().Get("expand")
+	if expand == "" {
+		return view, nil
+	}
+	for _, field := range strings.Split(expand, ",") {
+		switch strings.TrimSpace(field) {
+		case "author":
+			view.expandAuthor = true
+		default:
+			return view, errors.New("unknown expand field: " + field)
+		}
+	}
+	return view, nil
+}
+
+// newEmbeddedChirp renders the chirp with id for embedding, originals are
+// not embedded any further
+func newEmbeddedChirp(db database.Database, id int, view chirpView) *responseEmbeddedChirp {
+	embedded := &responseEmbeddedChirp{Id: id}
+
+	original, ok := db.Chirps[id]
+	if !ok || original.DeletedAt != nil || !newChirpPolicy(db, view).canSee(original) {
+		embedded.Unavailable = true
+		return embedded
+	}
+
+	view.embedded = true
+	response := newResponseChirp(db, original, view)
+	embedded.responseChirp = &response
+	return embedded
+}
+
+func newResponseChirp(db database.Database, chirp database.Chirp, view chirpView) responseChirp {
+	response := responseChirp{
+		Id: chirp.Id,
+		Body: chirp.Body,
+		AuthorId: chirp.AuthorId,
+		Attachments: chirp.Attachments,
+		InReplyToId: chirp.InReplyToId,
+		RootId: chirp.RootId,
+		ReplyCount: chirp.ReplyCount,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+		Deleted: chirp.DeletedAt != nil,
+		EditedAt: chirp.EditedAt,
+		LikeCount: len(db.ChirpLikes[chirp.Id]),
+		RechirpOfId: chirp.RechirpOfId,
+		QuoteOfId: chirp.QuoteOfId,
+		RechirpCount: len(db.Rechirps[chirp.Id]),
+		QuoteCount: chirp.QuoteCount,
+	}
+
+	if !view.embedded {
+		if chirp.RechirpOfId != 0 {
+			response.RechirpOf = newEmbeddedChirp(db, chirp.RechirpOfId, view)
+		}
+		if chirp.QuoteOfId != 0 {
+			response.QuoteOf = newEmbeddedChirp(db, chirp.QuoteOfId, view)
+		}
+	}
+
+	if view.viewerId != 0 {
+		_, liked := db.ChirpLikes[chirp.Id][view.viewerId]
+		response.LikedByMe = &liked
+	}
+
+	if view.expandAuthor {
+		author, ok := db.Users[chirp.AuthorId]
+		if ok {
+			summary := newAuthorSummary(author)
+			response.Author = &summary
+		}
+	}
+
+	return response
+}
+
+func newResponseChirps(db database.Database, chirps []database.Chirp, view chirpView) []responseChirp {
+	response := make([]responseChirp, 0, len(chirps))
+	for _, chirp := range chirps {
+		response = append(response, newResponseChirp(db, chirp, view))
+	}
+	return response
+}
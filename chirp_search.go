@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/search"
+)
+
+// searchOrder is the only order of search results. Relevance depends on
+// the whole index, so pages are cut by offset rather than by key.
+const searchOrder = "relevance"
+
+func handleChirpsSearchGet(w http.ResponseWriter, r *http.Request) {
+	type responseSearch struct {
+		Chirps []responseChirp `json:"chirps"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	query, err := search.ParseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	view, err := parseChirpView(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	offset := 0
+	if page.cursor != nil {
+		if page.cursor.Order != searchOrder {
+			chirpsRespondWithJsonError(w, "cursor was made for a different sort")
+			return
+		}
+		offset = page.cursor.Offset
+	}
+
+	filter, err := parseChirpFilter(r, page)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	results, db, err := database.SearchChirps(query)
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	policy := newChirpPolicy(db, view)
+	chirps := make([]database.Chirp, 0, len(results))
+	for _, result := range results {
+		chirp, ok := db.Chirps[result.Id]
+		if ok && filter.matches(chirp) && policy.inFeed(chirp) {
+			chirps = append(chirps, chirp)
+		}
+	}
+
+	if offset > len(chirps) {
+		offset = len(chirps)
+	}
+	chirps = chirps[offset:]
+
+	nextCursor := ""
+	if len(chirps) > page.limit {
+		chirps = chirps[:page.limit]
+		nextCursor = encodeCursor(pageCursor{
+			Order: searchOrder,
+			Offset: offset + page.limit,
+		})
+		setNextLinkHeader(w, r, nextCursor)
+	}
+
+	response := responseSearch{
+		Chirps: newResponseChirps(db, chirps, view),
+		NextCursor: nextCursor,
+	}
+
+	dat, err := json.Marshal(response)
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/pubsub"
+)
+
+const streamEventChirpCreated = "chirp.created"
+const streamEventChirpDeleted = "chirp.deleted"
+
+// chirpStreamBufferSize is how many recent events clients can resume from,
+// chirpStreamQueueSize how many may wait for a client before it is dropped
+const chirpStreamBufferSize = 1000
+const chirpStreamQueueSize = 64
+
+const chirpStreamHeartbeat = 15 * time.Second
+// chirpStreamWriteTimeout is how long a single write to a client may take
+const chirpStreamWriteTimeout = 10 * time.Second
+
+// streamEvent is a chirp event for the live streams
+type streamEvent struct {
+	Type string
+	ChirpId int
+	AuthorId int
+	// HiddenFrom are the viewers the event is left out for, worked out
+	// once when publishing so clients don't each load the database
+	HiddenFrom map[int]bool
+	// Data is the event as sent to clients
+	Data json.RawMessage
+}
+
+func newChirpEvents() *pubsub.Bus[streamEvent] {
+	return pubsub.New[streamEvent](chirpStreamBufferSize, chirpStreamQueueSize)
+}
+
+// publishStreamEvent sends an event about chirp to the live streams, db is
+// the snapshot blocks and mutes are taken from. Like webhooks it never
+// fails the request that caused it.
+func publishStreamEvent(events *pubsub.Bus[streamEvent], db database.Database, eventType string, chirp database.Chirp, data any) {
+	dat, err := json.Marshal(data)
+	if err != nil {
+		fmt.Println("Error publishing stream event:", err)
+		return
+	}
+	events.Publish(streamEvent{
+		Type: eventType,
+		ChirpId: chirp.Id,
+		AuthorId: chirp.AuthorId,
+		HiddenFrom: streamHiddenFrom(db, chirp),
+		Data: dat,
+	})
+}
+
+// streamHiddenFrom returns the viewers chirp is kept from: those blocked
+// by one of its authors, and those who blocked or muted one of them.
+func streamHiddenFrom(db database.Database, chirp database.Chirp) map[int]bool {
+	hidden := map[int]bool{}
+	for _, authorId := range newChirpPolicy(db, chirpView{}).authors(chirp) {
+		for blockedId := range db.Blocks[authorId] {
+			hidden[blockedId] = true
+		}
+		for _, relations := range []map[int]map[int]time.Time{db.Blocks, db.Mutes} {
+			for userId, others := range relations {
+				if _, ok := others[authorId]; ok {
+					hidden[userId] = true
+				}
+			}
+		}
+	}
+	return hidden
+}
+
+// parseLastEventId reads the id to resume after, sent by EventSource in the
+// Last-Event-ID header on reconnects. The last_event_id parameter is for
+// clients that can't set headers.
+func parseLastEventId(r *http.Request) (uint64, error) {
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("last_event_id")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, errors.New("Last-Event-ID must be an event id")
+	}
+	return id, nil
+}
+
+// handleChirpsStreamGet streams chirp.created and chirp.deleted events as
+// Server-Sent Events, optionally only those of one author. Clients that
+// fall behind are disconnected and can resume with Last-Event-ID. When
+// events were lost in between, a reset event tells them to refetch.
+func handleChirpsStreamGet(w http.ResponseWriter, r *http.Request, events *pubsub.Bus[streamEvent]) {
+	authorId := 0
+	if raw := r.URL.Query().Get("author_id"); raw != "" {
+		var err error
+		authorId, err = strconv.Atoi(raw)
+		if err != nil {
+			chirpsRespondWithJsonError(w, "author_id must be an integer")
+			return
+		}
+	}
+	lastEventId, err := parseLastEventId(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	var filter func(streamEvent) bool
+	if authorId != 0 {
+		filter = func(event streamEvent) bool {
+			return event.AuthorId == authorId
+		}
+	}
+	sub := events.Subscribe(lastEventId, filter)
+	defer sub.Close()
+
+	controller := http.NewResponseController(w)
+	write := func(format string, args ...any) error {
+		controller.SetWriteDeadline(time.Now().Add(chirpStreamWriteTimeout))
+		_, err := fmt.Fprintf(w, format, args...)
+		if err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	err = write(": connected\n\n")
+	if err != nil {
+		return
+	}
+	if sub.Missed() {
+		err = write("event: reset\ndata: {}\n\n")
+		if err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(chirpStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			err = write(": heartbeat\n\n")
+		case message, ok := <-sub.C():
+			if !ok {
+				// Dropped as a slow consumer, the client resumes from
+				// its last event
+				return
+			}
+			err = write("id: %d\nevent: %s\ndata: %s\n\n", message.Id, message.Value.Type, message.Value.Data)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+const defaultThreadDepth = 10
+const maxThreadDepth = 50
+
+type responseThreadNode struct {
+	responseChirp
+	Replies []responseThreadNode `json:"replies"`
+	// MoreReplies is set when the replies were cut off by the depth limit
+	MoreReplies bool `json:"more_replies,omitempty"`
+}
+
+type responseThread struct {
+	// FocusId is the chirp the thread was requested for
+	FocusId int `json:"focus_id"`
+	Root responseThreadNode `json:"root"`
+}
+
+// buildThreadNode renders chirp and its replies down to depth more levels
+func buildThreadNode(db database.Database, chirp database.Chirp, replies map[int][]database.Chirp, depth int, view chirpView) responseThreadNode {
+	node := responseThreadNode{
+		Replies: []responseThreadNode{},
+	}
+	if newChirpPolicy(db, view).canSee(chirp) {
+		node.responseChirp = newResponseChirp(db, chirp, view)
+	} else {
+		// Kept so the replies below still have a parent
+		hidden := database.Chirp{
+			Id: chirp.Id,
+			InReplyToId: chirp.InReplyToId,
+			RootId: chirp.RootId,
+			ReplyCount: chirp.ReplyCount,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+		}
+		node.responseChirp = newResponseChirp(db, hidden, view)
+		node.responseChirp.Hidden = true
+	}
+
+	children := replies[chirp.Id]
+	if depth == 0 {
+		node.MoreReplies = len(children) > 0
+		return node
+	}
+	for _, child := range children {
+		node.Replies = append(node.Replies, buildThreadNode(db, child, replies, depth-1, view))
+	}
+	return node
+}
+
+// handleChirpsThreadGet returns the whole conversation the chirp is part
+// of, starting from its root. depth is how many levels of replies below
+// the root are included.
+func handleChirpsThreadGet(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDB()
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	view, err := parseChirpView(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	depth := defaultThreadDepth
+	if raw := r.URL.Query().Get("depth"); raw != "" {
+		depth, err = strconv.Atoi(raw)
+		if err != nil || depth < 0 || depth > maxThreadDepth {
+			chirpsRespondWithJsonError(w, fmt.Sprintf("depth must be between 0 and %d", maxThreadDepth))
+			return
+		}
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		chirpsRespondWithBadRequestError(w)
+		return
+	}
+
+	chirp, ok := db.Chirps[id]
+	if !ok || !newChirpPolicy(db, view).canSee(chirp) {
+		chirpsRespondWithNotFoundError(w)
+		return
+	}
+
+	root := chirp
+	if chirp.RootId != 0 {
+		// Roots with replies are kept as tombstones, so this only
+		// falls back if the file was edited by hand
+		stored, ok := db.Chirps[chirp.RootId]
+		if ok {
+			root = stored
+		}
+	}
+
+	replies := map[int][]database.Chirp{}
+	for _, reply := range db.Chirps {
+		if reply.RootId == root.Id {
+			replies[reply.InReplyToId] = append(replies[reply.InReplyToId], reply)
+		}
+	}
+	for _, children := range replies {
+		sort.Slice(children, func(i, j int) bool {
+			return children[i].Id < children[j].Id
+		})
+	}
+
+	response := responseThread{
+		FocusId: chirp.Id,
+		Root: buildThreadNode(db, root, replies, depth, view),
+	}
+
+	dat, err := json.Marshal(response)
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
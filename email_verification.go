@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+const emailVerificationTokenLifetime = 24 * time.Hour
+
+
+// sendEmailVerification mails a token that proves userId owns email.
+func sendEmailVerification(mailer Mailer, userId int, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	err = database.SaveOneTimeToken(database.OneTimeToken{
+		Hash: hashToken(token),
+		Purpose: database.TokenPurposeEmailVerification,
+		UserId: userId,
+		Email: email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(emailVerificationTokenLifetime),
+	})
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(mailMessage{
+		To: email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf(
+			"Confirm this address for your Chirpy account.\n\n"+
+			"Use this token with POST /api/users/verify within %d hours:\n\n%s\n",
+			int(emailVerificationTokenLifetime.Hours()),
+			token,
+		),
+	})
+}
+
+
+func handleUsersVerifyPost(w http.ResponseWriter, r *http.Request) {
+	type requestVerify struct {
+		Token string `json:"token"`
+	}
+	type responseUser struct {
+		Id int `json:"id"`
+		Email string `json:"email"`
+		IsVerified bool `json:"is_verified"`
+	}
+
+	var body requestVerify
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil || body.Token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	token, err := database.ConsumeOneTimeToken(hashToken(body.Token), database.TokenPurposeEmailVerification)
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenExpired) || errors.Is(err, database.ErrTokenUsed) {
+		chirpsRespondWithJsonError(w, "Verification token is invalid or has expired")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user, err := database.VerifyUserEmail(token.UserId, token.Email)
+	if errors.Is(err, database.ErrUserNotFound) || errors.Is(err, database.ErrEmailNotPending) {
+		chirpsRespondWithJsonError(w, "Verification token is invalid or has expired")
+		return
+	}
+	if errors.Is(err, database.ErrEmailTaken) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := responseUser{
+		Id: user.Id,
+		Email: user.Email,
+		IsVerified: user.IsVerified,
+	}
+
+	dat, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+// handleUsersVerifyResendPost mails a new token for the pending email if
+// there is one, otherwise for the current email if it isn't verified yet.
+func handleUsersVerifyResendPost(w http.ResponseWriter, r *http.Request, mailer Mailer) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	email := p.User.PendingEmail
+	if email == "" && !p.User.IsVerified {
+		email = p.User.Email
+	}
+	if email == "" {
+		chirpsRespondWithJsonError(w, "Email is already verified")
+		return
+	}
+
+	err := sendEmailVerification(mailer, p.User.Id, email)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+// entitlements are what a user's membership lets them do
+type entitlements struct {
+	Tier string `json:"tier"`
+	MaxChirpLength int `json:"max_chirp_length"`
+	CanEditChirps bool `json:"can_edit_chirps"`
+	ChirpsPerHour int `json:"chirps_per_hour"`
+	MaxAttachments int `json:"max_attachments"`
+}
+
+// entitlementTiers holds the entitlements of free and Chirpy Red users
+type entitlementTiers struct {
+	free entitlements
+	red entitlements
+}
+
+func defaultEntitlementTiers() entitlementTiers {
+	return entitlementTiers{
+		free: entitlements{
+			Tier: database.TierFree,
+			MaxChirpLength: 140,
+			CanEditChirps: false,
+			ChirpsPerHour: 30,
+			MaxAttachments: 1,
+		},
+		red: entitlements{
+			Tier: database.TierRed,
+			MaxChirpLength: 280,
+			CanEditChirps: true,
+			ChirpsPerHour: 120,
+			MaxAttachments: 4,
+		},
+	}
+}
+
+// entitlementTiersFromEnv reads the FREE_* and RED_* settings, anything
+// not set keeps its default.
+func entitlementTiersFromEnv() (entitlementTiers, error) {
+	tiers := defaultEntitlementTiers()
+
+	for _, tier := range []struct {
+		prefix string
+		e *entitlements
+	}{
+		{"FREE_", &tiers.free},
+		{"RED_", &tiers.red},
+	} {
+		ints := []struct {
+			name string
+			value *int
+		}{
+			{tier.prefix + "MAX_CHIRP_LENGTH", &tier.e.MaxChirpLength},
+			{tier.prefix + "CHIRPS_PER_HOUR", &tier.e.ChirpsPerHour},
+			{tier.prefix + "MAX_ATTACHMENTS", &tier.e.MaxAttachments},
+		}
+		for _, setting := range ints {
+			raw := os.Getenv(setting.name)
+			if raw == "" {
+				continue
+			}
+			value, err := strconv.Atoi(raw)
+			if err != nil || value < 0 {
+				return tiers, fmt.Errorf("%s must be a non-negative integer", setting.name)
+			}
+			*setting.value = value
+		}
+
+		name := tier.prefix + "CAN_EDIT_CHIRPS"
+		if raw := os.Getenv(name); raw != "" {
+			value, err := strconv.ParseBool(raw)
+			if err != nil {
+				return tiers, fmt.Errorf("%s must be true or false", name)
+			}
+			tier.e.CanEditChirps = value
+		}
+	}
+
+	return tiers, nil
+}
+
+func (t entitlementTiers) forUser(user database.User) entitlements {
+	if user.IsChirpyRed {
+		return t.red
+	}
+	return t.free
+}
+
+func handleMeEntitlementsGet(w http.ResponseWriter, r *http.Request, tiers entitlementTiers) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	dat, err := json.Marshal(tiers.forUser(p.User))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
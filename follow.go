@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/pubsub"
+)
+
+// followsOrder is the only order of follower and following lists, newest
+// first
+const followsOrder = "followed_at:desc"
+
+type responseFollowState struct {
+	Following bool `json:"following"`
+	FollowerCount int `json:"follower_count"`
+}
+
+type responseFollow struct {
+	User authorSummary `json:"user"`
+	FollowedAt time.Time `json:"followed_at"`
+}
+
+func handleUsersFollowPut(w http.ResponseWriter, r *http.Request, notifications *pubsub.Bus[notificationEvent]) {
+	handleUsersFollowChange(w, r, true, notifications)
+}
+
+func handleUsersFollowDelete(w http.ResponseWriter, r *http.Request) {
+	handleUsersFollowChange(w, r, false, nil)
+}
+
+// handleUsersFollowChange follows or unfollows a user for the caller. Both
+// are idempotent and answer with the resulting state. New follows notify
+// the followed user.
+func handleUsersFollowChange(w http.ResponseWriter, r *http.Request, follow bool, notifications *pubsub.Bus[notificationEvent]) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	followee, ok := findUserByRef(db, chi.URLParam(r, "user"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var count int
+	if follow {
+		count, err = database.FollowUser(p.User.Id, followee.Id)
+	} else {
+		count, err = database.UnfollowUser(p.User.Id, followee.Id)
+	}
+	if errors.Is(err, database.ErrFollowSelf) {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrBlocked) {
+		respondWithJsonError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if _, alreadyFollowing := db.Follows[p.User.Id][followee.Id]; follow && !alreadyFollowing {
+		notify(notifications, db, followee.Id, p.User.Id, notification{Kind: notificationFollow})
+	}
+
+	dat, err := json.Marshal(responseFollowState{
+		Following: follow,
+		FollowerCount: count,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+func handleUsersFollowersGet(w http.ResponseWriter, r *http.Request) {
+	handleUsersFollowListGet(w, r, func(db database.Database, userId int) map[int]time.Time {
+		return db.Followers[userId]
+	})
+}
+
+func handleUsersFollowingGet(w http.ResponseWriter, r *http.Request) {
+	handleUsersFollowListGet(w, r, func(db database.Database, userId int) map[int]time.Time {
+		return db.Follows[userId]
+	})
+}
+
+// handleUsersFollowListGet lists one side of a user's follows, newest
+// first, along with the total count
+func handleUsersFollowListGet(w http.ResponseWriter, r *http.Request, relations func(db database.Database, userId int) map[int]time.Time) {
+	type responseFollows struct {
+		Count int `json:"count"`
+		Users []responseFollow `json:"users"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	if page.cursor != nil && page.cursor.Order != followsOrder {
+		chirpsRespondWithJsonError(w, "cursor was made for a different sort")
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user, ok := findUserByRef(db, chi.URLParam(r, "user"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	follows := relations(db, user.Id)
+	users := []responseFollow{}
+	for otherId, followedAt := range follows {
+		other, ok := db.Users[otherId]
+		if !ok {
+			continue
+		}
+		if page.cursor != nil && !newestFirstAfter(followedAt, otherId, page.cursor.Key, page.cursor.Id) {
+			continue
+		}
+		users = append(users, responseFollow{
+			User: newAuthorSummary(other),
+			FollowedAt: followedAt,
+		})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return newestFirstAfter(users[j].FollowedAt, users[j].User.Id, users[i].FollowedAt.UnixNano(), users[i].User.Id)
+	})
+
+	nextCursor := ""
+	if len(users) > page.limit {
+		users = users[:page.limit]
+		last := users[len(users)-1]
+		nextCursor = encodeCursor(pageCursor{
+			Order: followsOrder,
+			Key: last.FollowedAt.UnixNano(),
+			Id: last.User.Id,
+		})
+		setNextLinkHeader(w, r, nextCursor)
+	}
+
+	dat, err := json.Marshal(responseFollows{
+		Count: len(follows),
+		Users: users,
+		NextCursor: nextCursor,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
@@ -3,8 +3,10 @@ module github.com/daniilgaltsev/chirpylike
 go 1.21.0
 
 require (
-	github.com/go-chi/chi/v5 v5.0.10 // indirect
-	github.com/golang-jwt/jwt/v5 v5.0.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	golang.org/x/crypto v0.13.0 // indirect
+	github.com/go-chi/chi/v5 v5.0.10
+	github.com/golang-jwt/jwt/v5 v5.0.0
+	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.13.0
 )
+
+require golang.org/x/sys v0.12.0 // indirect
@@ -4,15 +4,58 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/daniilgaltsev/chirpylike/internal/search"
 )
 
 type Chirp struct {
 	Id int `json:"id"`
 	Body string `json:"body"`
 	AuthorId int `json:"author_id"`
+	// Attachments are URLs of media shown with the chirp
+	Attachments []string `json:"attachments,omitempty"`
+	// InReplyToId is the chirp this one replies to and RootId the chirp
+	// that started the conversation, both are zero for top level chirps
+	InReplyToId int `json:"in_reply_to_id,omitempty"`
+	RootId int `json:"root_id,omitempty"`
+	ReplyCount int `json:"reply_count"`
+	// RechirpOfId is the chirp shared as is, rechirps have no body.
+	// QuoteOfId is the chirp shared with the body as commentary.
+	RechirpOfId int `json:"rechirp_of_id,omitempty"`
+	QuoteOfId int `json:"quote_of_id,omitempty"`
+	QuoteCount int `json:"quote_count"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is set on tombstones, deleted chirps kept without body and
+	// author because there are replies to them
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// EditedAt is when the body was last changed, previous bodies are
+	// kept in ChirpRevisions
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+}
+
+// ChirpRevision is a body a chirp had before it was edited
+type ChirpRevision struct {
+	Body string `json:"body"`
+	// CreatedAt is when the chirp got this body and ReplacedAt when it
+	// was edited away
+	CreatedAt time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// ChirpDraft is a chirp to be saved, the rest is filled in by SaveChirp
+type ChirpDraft struct {
+	Body string
+	AuthorId int
+	Attachments []string
+	InReplyToId int
+	RechirpOfId int
+	QuoteOfId int
 }
 
 type User struct {
@@ -20,38 +63,471 @@ type User struct {
 	Email string `json:"email"`
 	Password string `json:"password"`
 	IsChirpyRed bool `json:"is_chirpy_red"`
+	IsVerified bool `json:"is_verified"`
+	Handle string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Bio string `json:"bio,omitempty"`
+	AvatarUrl string `json:"avatar_url,omitempty"`
+	// PendingEmail is an address the user asked to switch to, it replaces
+	// Email only once it has been verified.
+	PendingEmail string `json:"pending_email,omitempty"`
+	TotpEnabled bool `json:"totp_enabled"`
+	TotpSecret string `json:"totp_secret,omitempty"`
+	// TotpPendingSecret is a secret handed out during enrollment that
+	// hasn't been confirmed with a code yet
+	TotpPendingSecret string `json:"totp_pending_secret,omitempty"`
+	// TotpLastStep is the last time step a code was accepted for,
+	// codes can't be reused within their validity window
+	TotpLastStep int64 `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type PersonalAccessToken struct {
+	Id int `json:"id"`
+	UserId int `json:"user_id"`
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Scopes []string `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+const TokenPurposePasswordReset = "password_reset"
+const TokenPurposeEmailVerification = "email_verification"
+
+// OneTimeToken is a short-lived token mailed to a user, stored by its hash.
+type OneTimeToken struct {
+	Hash string `json:"hash"`
+	Purpose string `json:"purpose"`
+	UserId int `json:"user_id"`
+	// Email is the address an email verification token was sent to
+	Email string `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+const TierFree = "free"
+const TierRed = "red"
+
+const MembershipStatusActive = "active"
+// MembershipStatusCancelled memberships stay active until they expire,
+// they just won't be renewed
+const MembershipStatusCancelled = "cancelled"
+const MembershipStatusExpired = "expired"
+const MembershipStatusRefunded = "refunded"
+const MembershipStatusDowngraded = "downgraded"
+
+const MembershipEventUpgraded = "user.upgraded"
+const MembershipEventDowngraded = "user.downgraded"
+const MembershipEventRenewed = "subscription.renewed"
+const MembershipEventCancelled = "subscription.cancelled"
+const MembershipEventRefunded = "payment.refunded"
+// MembershipEventExpired is recorded by ExpireMemberships, it doesn't
+// come from Polka
+const MembershipEventExpired = "membership.expired"
+
+// MembershipChange is an entry in the history of a membership
+type MembershipChange struct {
+	Event string `json:"event"`
+	Tier string `json:"tier"`
+	Status string `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+	At time.Time `json:"at"`
+}
+
+// Membership is a user's Chirpy Red subscription. User.IsChirpyRed is kept
+// in sync with Tier.
+type Membership struct {
+	UserId int `json:"user_id"`
+	Tier string `json:"tier"`
+	Status string `json:"status"`
+	StartedAt time.Time `json:"started_at"`
+	// ExpiresAt is the end of the paid period
+	ExpiresAt time.Time `json:"expires_at"`
+	History []MembershipChange `json:"history"`
+}
+
+const WebhookSourcePolka = "polka"
+
+// Outcomes of processing a webhook event
+const WebhookOutcomeProcessed = "processed"
+// WebhookOutcomeIgnored events are of a type nothing is done for
+const WebhookOutcomeIgnored = "ignored"
+const WebhookOutcomeDuplicate = "duplicate"
+// WebhookOutcomeRejected events failed authentication or verification
+const WebhookOutcomeRejected = "rejected"
+const WebhookOutcomeInvalid = "invalid"
+const WebhookOutcomeUserNotFound = "user_not_found"
+const WebhookOutcomeFailed = "failed"
+
+// WebhookAttempt is one processing of a webhook event, either when it was
+// delivered or when an admin replayed it
+type WebhookAttempt struct {
+	Outcome string `json:"outcome"`
+	Error string `json:"error,omitempty"`
+	Replay bool `json:"replay"`
+	At time.Time `json:"at"`
+}
+
+// WebhookEvent is a received webhook request, stored as it arrived
+type WebhookEvent struct {
+	Id int `json:"id"`
+	Source string `json:"source"`
+	// EventId, EventType and UserId are read from the body when it parses
+	EventId string `json:"event_id,omitempty"`
+	EventType string `json:"event_type,omitempty"`
+	UserId int `json:"user_id,omitempty"`
+	Headers map[string]string `json:"headers"`
+	Body string `json:"body"`
+	// Requests that fail verification only keep the start of the body,
+	// BodySha256 is then the hash of all of it
+	BodyTruncated bool `json:"body_truncated,omitempty"`
+	BodySha256 string `json:"body_sha256,omitempty"`
+	Verified bool `json:"verified"`
+	VerificationError string `json:"verification_error,omitempty"`
+	// Outcome is the outcome of the latest attempt
+	Outcome string `json:"outcome"`
+	Attempts []WebhookAttempt `json:"attempts"`
+	ReceivedAt time.Time `json:"received_at"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+}
+
+// WebhookEndpoint is a URL outgoing webhooks are delivered to
+type WebhookEndpoint struct {
+	Id int `json:"id"`
+	Url string `json:"url"`
+	// Events are the event types delivered to the endpoint
+	Events []string `json:"events"`
+	// Secret signs the deliveries
+	Secret string `json:"secret"`
+	Active bool `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type WebhookEndpointUpdate struct {
+	Url *string
+	Events []string
+	Active *bool
+}
+
+const WebhookDeliveryPending = "pending"
+const WebhookDeliveryDelivered = "delivered"
+// WebhookDeliveryDead deliveries failed too often and are not retried
+// unless an admin queues them again
+const WebhookDeliveryDead = "dead"
+
+// WebhookDeliveryAttempt is one request made for a delivery
+type WebhookDeliveryAttempt struct {
+	// StatusCode is zero when no response was received
+	StatusCode int `json:"status_code,omitempty"`
+	Error string `json:"error,omitempty"`
+	DurationMs int64 `json:"duration_ms"`
+	At time.Time `json:"at"`
+}
+
+// Succeeded reports whether the endpoint accepted the delivery
+func (a WebhookDeliveryAttempt) Succeeded() bool {
+	return a.Error == "" && a.StatusCode >= 200 && a.StatusCode < 300
+}
+
+// WebhookDelivery is an event to be sent to one endpoint
+type WebhookDelivery struct {
+	Id int `json:"id"`
+	EndpointId int `json:"endpoint_id"`
+	// EventId is shared by the deliveries of the same event to different
+	// endpoints
+	EventId string `json:"event_id"`
+	Event string `json:"event"`
+	// Payload is the request body, the same for every attempt
+	Payload string `json:"payload"`
+	Status string `json:"status"`
+	Attempts []WebhookDeliveryAttempt `json:"attempts"`
+	// Failures counts the failed attempts since the delivery was queued
+	Failures int `json:"failures"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Session is a refresh token handed out at login, stored by its hash.
+type Session struct {
+	Id int `json:"id"`
+	UserId int `json:"user_id"`
+	TokenHash string `json:"token_hash"`
+	IpAddress string `json:"ip_address"`
+	UserAgent string `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
 }
 
+// currentSchemaVersion is bumped whenever loading older files needs more
+// than the missing maps created, see migrate
+const currentSchemaVersion = 3
+
+// polkaEventIdRetention is how long processed event ids are remembered
+const polkaEventIdRetention = 30 * 24 * time.Hour
+
+// webhookEventRetention is how long received webhooks are kept, and
+// maxWebhookEvents how many at most, the oldest are dropped first
+const webhookEventRetention = 30 * 24 * time.Hour
+const maxWebhookEvents = 10000
+
+// LegacyMembershipPeriod is how long members upgraded before memberships
+// were tracked stay Red without a renewal
+const LegacyMembershipPeriod = 30 * 24 * time.Hour
+
+// maxTimelineLength is how many chirps a home timeline keeps, older ones
+// fall off the end
+const maxTimelineLength = 1000
+
 type Database struct {
+	SchemaVersion int `json:"schemaVersion"`
 	Chirps map[int]Chirp `json:"chirps"`
 	Users map[int]User `json:"users"`
 	RevokedTokens map[string]bool `json:"revokedTokens"`
+	PersonalAccessTokens map[int]PersonalAccessToken `json:"personalAccessTokens"`
+	OneTimeTokens map[string]OneTimeToken `json:"oneTimeTokens"`
+	Sessions map[int]Session `json:"sessions"`
+	// ChirpLikes maps a chirp to the users who liked it and when, the
+	// like count of a chirp is the size of its map
+	ChirpLikes map[int]map[int]time.Time `json:"chirpLikes"`
+	// Rechirps maps a chirp to the users who rechirped it and the ids of
+	// their rechirps, the rechirp count of a chirp is the size of its map
+	Rechirps map[int]map[int]int `json:"rechirps"`
+	// Follows maps a user to the users they follow and since when,
+	// Followers is the same relation the other way around
+	Follows map[int]map[int]time.Time `json:"follows"`
+	Followers map[int]map[int]time.Time `json:"followers"`
+	// Timelines are the chirp ids, oldest first, of each user's home
+	// timeline. Chirps are fanned out to them when posted.
+	Timelines map[int][]int `json:"timelines"`
+	// Blocks and Mutes map a user to the users they blocked or muted and
+	// since when
+	Blocks map[int]map[int]time.Time `json:"blocks"`
+	Mutes map[int]map[int]time.Time `json:"mutes"`
+	// ChirpRevisions are the previous bodies of edited chirps, oldest first
+	ChirpRevisions map[int][]ChirpRevision `json:"chirpRevisions"`
+	// Memberships are keyed by user id
+	Memberships map[int]Membership `json:"memberships"`
+	// PolkaEventIds are the ids of processed Polka events and when they
+	// were processed, so redeliveries are only applied once
+	PolkaEventIds map[string]time.Time `json:"polkaEventIds"`
+	// WebhookEvents are the received webhook requests
+	WebhookEvents map[int]WebhookEvent `json:"webhookEvents"`
+	WebhookEndpoints map[int]WebhookEndpoint `json:"webhookEndpoints"`
+	WebhookDeliveries map[int]WebhookDelivery `json:"webhookDeliveries"`
+	// LastIds is the last id handed out per table, ids of deleted
+	// records are never reused
+	LastIds map[string]int `json:"lastIds"`
 }
 
 const DbPath = "./database.json"
 var dbLock = sync.Mutex{}
 
-func loadDB() (Database, error) {
-	var db Database
+// chirpIndex is the full-text index of chirp bodies. It is built from the
+// file on the first search and then kept in sync by the functions changing
+// chirps, guarded by dbLock.
+var chirpIndex *search.Index
+
+var ErrChirpNotFound = errors.New("Chirp not found")
+var ErrChirpDeleted = errors.New("Chirp was deleted")
+var ErrAlreadyRechirped = errors.New("Chirp already rechirped")
+var ErrFollowSelf = errors.New("Users can't follow themselves")
+var ErrBlocked = errors.New("Blocked by the user")
+var ErrRelationSelf = errors.New("Users can't block or mute themselves")
+var ErrDuplicateEvent = errors.New("Event already processed")
+var ErrWebhookEventNotFound = errors.New("Webhook event not found")
+var ErrWebhookEndpointNotFound = errors.New("Webhook endpoint not found")
+var ErrWebhookDeliveryNotFound = errors.New("Webhook delivery not found")
+var ErrUserNotFound = errors.New("User not found")
+var ErrEmailTaken = errors.New("Email already in use")
+var ErrPasswordChanged = errors.New("Password changed in the meantime")
+var ErrEmailNotPending = errors.New("Email is no longer waiting for verification")
+var ErrHandleTaken = errors.New("Handle already in use")
+var ErrHandleReserved = errors.New("Handle is reserved")
+var ErrTotpNotPending = errors.New("TOTP enrollment not started")
+var ErrTotpStepUsed = errors.New("TOTP code already used")
+var ErrRecoveryCodeInvalid = errors.New("Recovery code is invalid")
+var ErrTokenNotFound = errors.New("Token not found")
+var ErrTokenExpired = errors.New("Token expired")
+var ErrTokenUsed = errors.New("Token already used")
+
+func newDatabase() Database {
+	db := Database{SchemaVersion: currentSchemaVersion}
+	db.initialize()
+	return db
+}
+
+// initialize creates the maps missing from db. Files written before a map
+// was introduced decode with it set to nil, so this runs on every load.
+func (db *Database) initialize() {
+	if db.Chirps == nil {
+		db.Chirps = map[int]Chirp{}
+	}
+	if db.Users == nil {
+		db.Users = map[int]User{}
+	}
+	if db.RevokedTokens == nil {
+		db.RevokedTokens = map[string]bool{}
+	}
+	if db.PersonalAccessTokens == nil {
+		db.PersonalAccessTokens = map[int]PersonalAccessToken{}
+	}
+	if db.OneTimeTokens == nil {
+		db.OneTimeTokens = map[string]OneTimeToken{}
+	}
+	if db.Sessions == nil {
+		db.Sessions = map[int]Session{}
+	}
+	if db.ChirpLikes == nil {
+		db.ChirpLikes = map[int]map[int]time.Time{}
+	}
+	if db.Rechirps == nil {
+		db.Rechirps = map[int]map[int]int{}
+	}
+	if db.Follows == nil {
+		db.Follows = map[int]map[int]time.Time{}
+	}
+	if db.Followers == nil {
+		db.Followers = map[int]map[int]time.Time{}
+	}
+	if db.Timelines == nil {
+		db.Timelines = map[int][]int{}
+	}
+	if db.Blocks == nil {
+		db.Blocks = map[int]map[int]time.Time{}
+	}
+	if db.Mutes == nil {
+		db.Mutes = map[int]map[int]time.Time{}
+	}
+	if db.ChirpRevisions == nil {
+		db.ChirpRevisions = map[int][]ChirpRevision{}
+	}
+	if db.Memberships == nil {
+		db.Memberships = map[int]Membership{}
+	}
+	if db.WebhookEndpoints == nil {
+		db.WebhookEndpoints = map[int]WebhookEndpoint{}
+	}
+	if db.WebhookDeliveries == nil {
+		db.WebhookDeliveries = map[int]WebhookDelivery{}
+	}
+	if db.WebhookEvents == nil {
+		db.WebhookEvents = map[int]WebhookEvent{}
+	}
+	if db.PolkaEventIds == nil {
+		db.PolkaEventIds = map[string]time.Time{}
+	}
+	if db.LastIds == nil {
+		db.LastIds = map[string]int{}
+	}
+}
 
+func loadDB() (Database, error) {
 	raw, err := os.ReadFile(DbPath)
 	if os.IsNotExist(err) {
-		db = Database{ // TODO: don't like that we have to initialize this here, separately from definition
-			Chirps: map[int]Chirp{},
-			Users: map[int]User{},
-			RevokedTokens: map[string]bool{},
-		}
-	} else {
-		err = json.Unmarshal(raw, &db)
+		return newDatabase(), nil
+	}
+	if err != nil {
+		return Database{}, err
+	}
 
+	var db Database
+	err = json.Unmarshal(raw, &db)
+	if err != nil {
+		return db, err
+	}
+	db.initialize()
+
+	if db.SchemaVersion < currentSchemaVersion {
+		info, err := os.Stat(DbPath)
 		if err != nil {
 			return db, err
 		}
+		db.migrate(info.ModTime().UTC())
 	}
 
 	return db, nil
 }
 
+// migrate brings a file written by an older version up to date. The result
+// is written back with the next save. modTime is when the file was last
+// written, the best guess there is for records missing timestamps.
+func (db *Database) migrate(modTime time.Time) {
+	if db.SchemaVersion < 1 {
+		for id, chirp := range db.Chirps {
+			if chirp.CreatedAt.IsZero() {
+				chirp.CreatedAt = modTime
+				chirp.UpdatedAt = modTime
+				db.Chirps[id] = chirp
+			}
+		}
+		for id, user := range db.Users {
+			if user.CreatedAt.IsZero() {
+				user.CreatedAt = modTime
+				user.UpdatedAt = modTime
+				db.Users[id] = user
+			}
+		}
+	}
+
+	if db.SchemaVersion < 2 {
+		// Nobody followed anyone yet, timelines are just the own chirps
+		for _, chirp := range db.Chirps {
+			if chirp.DeletedAt == nil && chirp.AuthorId != 0 {
+				db.Timelines[chirp.AuthorId] = append(db.Timelines[chirp.AuthorId], chirp.Id)
+			}
+		}
+		for userId, timeline := range db.Timelines {
+			db.Timelines[userId] = trimTimeline(timeline)
+		}
+	}
+
+	if db.SchemaVersion < 3 {
+		// Upgrades used to be permanent, they get one period to renew
+		for id, user := range db.Users {
+			if !user.IsChirpyRed {
+				continue
+			}
+			if _, ok := db.Memberships[id]; ok {
+				continue
+			}
+			membership := Membership{UserId: id}
+			membership.apply(MembershipEventUpgraded, modTime.Add(LegacyMembershipPeriod), modTime)
+			db.Memberships[id] = membership
+		}
+	}
+
+	db.SchemaVersion = currentSchemaVersion
+}
+
+func maxId[T any](m map[int]T) int {
+	id := 0
+	for key := range m {
+		if key > id {
+			id = key
+		}
+	}
+	return id
+}
+
+// allocateId returns a new id for table. existing is the largest id in the
+// table, which covers files written before LastIds was tracked.
+func (db *Database) allocateId(table string, existing int) int {
+	id := db.LastIds[table]
+	if existing > id {
+		id = existing
+	}
+	id++
+	db.LastIds[table] = id
+	return id
+}
+
 func saveDB(db Database) error {
 	raw, err := json.Marshal(db)
 	if err != nil {
@@ -62,30 +538,181 @@ func saveDB(db Database) error {
 	return err
 }
 
-func addChirp(chirpBody string, authorId int, db Database) (Chirp, Database) {
-	id := len(db.Chirps) + 1
+// sharedChirp returns the chirp that can be replied to, rechirped or quoted
+// for id. Rechirps stand for their original.
+func (db *Database) sharedChirp(id int) (Chirp, error) {
+	chirp, ok := db.Chirps[id]
+	if ok && chirp.RechirpOfId != 0 {
+		chirp, ok = db.Chirps[chirp.RechirpOfId]
+	}
+	if !ok {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if chirp.DeletedAt != nil {
+		return Chirp{}, ErrChirpDeleted
+	}
+	return chirp, nil
+}
+
+func addChirp(draft ChirpDraft, db Database) (Chirp, Database, error) {
 	chirp := Chirp{
-		Id: id,
-		Body: chirpBody,
-		AuthorId: authorId,
+		Body: draft.Body,
+		AuthorId: draft.AuthorId,
+		Attachments: draft.Attachments,
 	}
-	db.Chirps[id] = chirp
-	return chirp, db
+
+	if draft.InReplyToId != 0 {
+		parent, err := db.sharedChirp(draft.InReplyToId)
+		if err != nil {
+			return Chirp{}, db, err
+		}
+		if db.IsBlocked(parent.AuthorId, chirp.AuthorId) {
+			return Chirp{}, db, ErrBlocked
+		}
+		chirp.InReplyToId = parent.Id
+		chirp.RootId = parent.RootId
+		if chirp.RootId == 0 {
+			chirp.RootId = parent.Id
+		}
+		parent.ReplyCount++
+		db.Chirps[parent.Id] = parent
+	}
+
+	if draft.QuoteOfId != 0 {
+		quoted, err := db.sharedChirp(draft.QuoteOfId)
+		if err != nil {
+			return Chirp{}, db, err
+		}
+		if db.IsBlocked(quoted.AuthorId, chirp.AuthorId) {
+			return Chirp{}, db, ErrBlocked
+		}
+		chirp.QuoteOfId = quoted.Id
+		quoted.QuoteCount++
+		db.Chirps[quoted.Id] = quoted
+	}
+
+	chirp.Id = db.allocateId("chirps", maxId(db.Chirps))
+
+	if draft.RechirpOfId != 0 {
+		original, err := db.sharedChirp(draft.RechirpOfId)
+		if err != nil {
+			return Chirp{}, db, err
+		}
+		if db.IsBlocked(original.AuthorId, chirp.AuthorId) {
+			return Chirp{}, db, ErrBlocked
+		}
+		rechirps, ok := db.Rechirps[original.Id]
+		if !ok {
+			rechirps = map[int]int{}
+			db.Rechirps[original.Id] = rechirps
+		}
+		if _, done := rechirps[chirp.AuthorId]; done {
+			return Chirp{}, db, ErrAlreadyRechirped
+		}
+		chirp.RechirpOfId = original.Id
+		rechirps[chirp.AuthorId] = chirp.Id
+	}
+
+	now := time.Now().UTC()
+	chirp.CreatedAt = now
+	chirp.UpdatedAt = now
+	db.Chirps[chirp.Id] = chirp
+
+	db.Timelines[chirp.AuthorId] = trimTimeline(append(db.Timelines[chirp.AuthorId], chirp.Id))
+	for followerId := range db.Followers[chirp.AuthorId] {
+		db.Timelines[followerId] = trimTimeline(append(db.Timelines[followerId], chirp.Id))
+	}
+	return chirp, db, nil
+}
+
+// trimTimeline sorts timeline and drops the oldest chirps past the limit
+func trimTimeline(timeline []int) []int {
+	sort.Ints(timeline)
+	if len(timeline) > maxTimelineLength {
+		timeline = timeline[len(timeline)-maxTimelineLength:]
+	}
+	return timeline
+}
+
+// removeChirp deletes the chirp, or turns it into a tombstone if there are
+// replies to it. A tombstone left without replies is removed as well, and
+// so are the rechirps of the chirp. It returns the ids of all chirps whose
+// content is gone.
+func (db *Database) removeChirp(id int) []int {
+	chirp, ok := db.Chirps[id]
+	if !ok {
+		return nil
+	}
+	removed := []int{id}
+
+	delete(db.ChirpLikes, id)
+	delete(db.ChirpRevisions, id)
+	for _, rechirpId := range db.Rechirps[id] {
+		removed = append(removed, db.removeChirp(rechirpId)...)
+	}
+	delete(db.Rechirps, id)
+
+	if chirp.RechirpOfId != 0 {
+		rechirps := db.Rechirps[chirp.RechirpOfId]
+		delete(rechirps, chirp.AuthorId)
+		if len(rechirps) == 0 {
+			delete(db.Rechirps, chirp.RechirpOfId)
+		}
+	}
+	if chirp.QuoteOfId != 0 {
+		quoted, ok := db.Chirps[chirp.QuoteOfId]
+		if ok {
+			quoted.QuoteCount--
+			db.Chirps[quoted.Id] = quoted
+		}
+	}
+
+	if chirp.ReplyCount > 0 {
+		now := time.Now().UTC()
+		chirp.Body = ""
+		chirp.AuthorId = 0
+		chirp.Attachments = nil
+		chirp.QuoteOfId = 0
+		chirp.UpdatedAt = now
+		chirp.DeletedAt = &now
+		db.Chirps[id] = chirp
+		return removed
+	}
+
+	delete(db.Chirps, id)
+	if chirp.InReplyToId == 0 {
+		return removed
+	}
+	parent, ok := db.Chirps[chirp.InReplyToId]
+	if !ok {
+		return removed
+	}
+	parent.ReplyCount--
+	db.Chirps[parent.Id] = parent
+	if parent.DeletedAt != nil && parent.ReplyCount == 0 {
+		db.removeChirp(parent.Id)
+	}
+	return removed
 }
 
 func addUser(email, password string, db Database) (User, Database) {
-	id := len(db.Users) + 1
+	id := db.allocateId("users", maxId(db.Users))
+	now := time.Now().UTC()
 	user := User{
 		Id: id,
 		Email: email,
 		Password: password,
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
 	db.Users[id] = user
 	return user, db
 }
 
 
-func SaveChirp(chirpBody string, authorId int) (Chirp, error) {
+// SaveChirp stores a new chirp. Replies fail with ErrChirpNotFound or
+// ErrChirpDeleted if there is nothing to reply to.
+func SaveChirp(draft ChirpDraft) (Chirp, error) {
 	dbLock.Lock()
 	defer dbLock.Unlock()
 	db, err := loadDB()
@@ -93,111 +720,1381 @@ func SaveChirp(chirpBody string, authorId int) (Chirp, error) {
 		return Chirp{}, err
 	}
 
-	chirp, db := addChirp(chirpBody, authorId, db)
+	chirp, db, err := addChirp(draft, db)
+	if err != nil {
+		return Chirp{}, err
+	}
 	err = saveDB(db)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirpIndex != nil {
+		chirpIndex.Add(chirp.Id, chirp.Body)
+	}
 
-	return chirp, err
+	return chirp, nil
 }
 
-func SaveUser(email, password string) (User, error) {
+// SaveUser stores a new user, passwordHash is already hashed by the caller.
+// It fails with ErrEmailTaken if another account has the email.
+func SaveUser(email, passwordHash string) (User, error) {
 	dbLock.Lock()
 	defer dbLock.Unlock()
 	db, err := loadDB()
 	if err != nil {
 		return User{}, err
 	}
-
-	const cost = 10
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), cost)
-	if err != nil {
-		return User{}, err
+	if emailTaken(db, email, 0) {
+		return User{}, ErrEmailTaken
 	}
-	user, db := addUser(email, string(hashedPassword), db)
+
+	user, db := addUser(email, passwordHash, db)
 	err = saveDB(db)
 
 	return user, err
 }
 
-func UpdateUserMembership(id int) error {
+func GetUser(id int) (User, error) {
 	db, err := GetDB()
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
 	user, ok := db.Users[id]
 	if !ok {
-		return errors.New("User not found")
+		return User{}, ErrUserNotFound
 	}
 
-	user.IsChirpyRed = true
-	db.Users[id] = user
-	err = saveDB(db)
-	return err
+	return user, nil
 }
 
-func UpdateUser(id int, email, password string) (User, error) {
+func GetUserByEmail(email string) (User, error) {
 	db, err := GetDB()
 	if err != nil {
 		return User{}, err
 	}
 
-	user, ok := db.Users[id]
+	for _, user := range db.Users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+// apply changes the membership for event. paidUntil is the end of the paid
+// period for upgrades and renewals.
+func (m *Membership) apply(event string, paidUntil, now time.Time) {
+	switch event {
+	case MembershipEventUpgraded:
+		if m.Tier != TierRed {
+			m.StartedAt = now
+		}
+		m.Tier = TierRed
+		m.Status = MembershipStatusActive
+		m.ExpiresAt = paidUntil
+	case MembershipEventRenewed:
+		if m.Tier != TierRed {
+			m.StartedAt = now
+		}
+		m.Tier = TierRed
+		m.Status = MembershipStatusActive
+		if paidUntil.After(m.ExpiresAt) {
+			m.ExpiresAt = paidUntil
+		}
+	case MembershipEventCancelled:
+		if m.Tier == TierRed {
+			m.Status = MembershipStatusCancelled
+		}
+	case MembershipEventRefunded:
+		m.Tier = TierFree
+		m.Status = MembershipStatusRefunded
+		m.ExpiresAt = now
+	case MembershipEventDowngraded:
+		m.Tier = TierFree
+		m.Status = MembershipStatusDowngraded
+		m.ExpiresAt = now
+	case MembershipEventExpired:
+		m.Tier = TierFree
+		m.Status = MembershipStatusExpired
+	}
+
+	m.History = append(m.History, MembershipChange{
+		Event: event,
+		Tier: m.Tier,
+		Status: m.Status,
+		ExpiresAt: m.ExpiresAt,
+		At: now,
+	})
+}
+
+// ApplyMembershipEvent records a Polka event on the user's membership.
+// paidUntil is the end of the paid period for upgrades and renewals. An
+// event with an eventId that was already applied fails with
+// ErrDuplicateEvent, so eventId must not be empty.
+func ApplyMembershipEvent(eventId string, userId int, event string, paidUntil time.Time) (Membership, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return Membership{}, err
+	}
+
+	if _, seen := db.PolkaEventIds[eventId]; seen {
+		return Membership{}, ErrDuplicateEvent
+	}
+
+	user, ok := db.Users[userId]
 	if !ok {
-		return User{}, errors.New("User not found")
+		return Membership{}, ErrUserNotFound
 	}
 
-	if email != "" {
-		user.Email = email
+	membership, ok := db.Memberships[userId]
+	if !ok {
+		membership = Membership{UserId: userId, Tier: TierFree}
 	}
-	if password != "" {
-		const cost = 10 // TODO: need to consolidate password encryption
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), cost)
-		if err != nil {
-			return User{}, err
+	now := time.Now().UTC()
+	membership.apply(event, paidUntil.UTC(), now)
+	db.Memberships[userId] = membership
+
+	for id, processedAt := range db.PolkaEventIds {
+		if now.Sub(processedAt) > polkaEventIdRetention {
+			delete(db.PolkaEventIds, id)
 		}
-		user.Password = string(hashedPassword)
+	}
+	db.PolkaEventIds[eventId] = now
+
+	if user.IsChirpyRed != (membership.Tier == TierRed) {
+		user.IsChirpyRed = membership.Tier == TierRed
+		user.UpdatedAt = now
+		db.Users[userId] = user
 	}
 
-	db.Users[id] = user
 	err = saveDB(db)
-	return user, err
+	return membership, err
 }
 
-func DeleteChirp(id int) error {
-	db, err := GetDB()
+// ExpireMemberships ends the Red memberships whose paid period is over and
+// returns them.
+func ExpireMemberships(now time.Time) ([]Membership, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	expired := []Membership{}
+	for userId, membership := range db.Memberships {
+		if membership.Tier != TierRed || now.Before(membership.ExpiresAt) {
+			continue
+		}
+		membership.apply(MembershipEventExpired, membership.ExpiresAt, now.UTC())
+		db.Memberships[userId] = membership
+
+		user, ok := db.Users[userId]
+		if ok {
+			user.IsChirpyRed = false
+			user.UpdatedAt = now.UTC()
+			db.Users[userId] = user
+		}
+		expired = append(expired, membership)
+	}
+
+	if len(expired) == 0 {
+		return expired, nil
+	}
+	return expired, saveDB(db)
+}
+
+// SaveWebhookEvent stores a received webhook under a new id, dropping the
+// events past their retention.
+func SaveWebhookEvent(event WebhookEvent) (WebhookEvent, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	event.Id = db.allocateId("webhookEvents", maxId(db.WebhookEvents))
+	event.ReceivedAt = event.ReceivedAt.UTC()
+	if event.Attempts == nil {
+		event.Attempts = []WebhookAttempt{}
+	}
+	db.WebhookEvents[event.Id] = event
+
+	ids := []int{}
+	for id, other := range db.WebhookEvents {
+		if event.ReceivedAt.Sub(other.ReceivedAt) > webhookEventRetention {
+			delete(db.WebhookEvents, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > maxWebhookEvents {
+		sort.Ints(ids)
+		for _, id := range ids[:len(ids)-maxWebhookEvents] {
+			delete(db.WebhookEvents, id)
+		}
+	}
+
+	err = saveDB(db)
+	return event, err
+}
+
+// RecordWebhookAttempt adds the outcome of processing a stored webhook
+func RecordWebhookAttempt(id int, attempt WebhookAttempt) (WebhookEvent, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return WebhookEvent{}, err
 	}
 
-	_, ok := db.Chirps[id]
+	event, ok := db.WebhookEvents[id]
 	if !ok {
-		return errors.New("Chirp not found")
+		return WebhookEvent{}, ErrWebhookEventNotFound
 	}
 
-	delete(db.Chirps, id)
+	attempt.At = attempt.At.UTC()
+	event.Attempts = append(event.Attempts, attempt)
+	event.Outcome = attempt.Outcome
+	event.ProcessedAt = &attempt.At
+	db.WebhookEvents[id] = event
+
 	err = saveDB(db)
-	return err
+	return event, err
 }
 
-func RevokedTokenExists(token string) (bool, error) {
+func GetWebhookEvent(id int) (WebhookEvent, error) {
 	db, err := GetDB()
 	if err != nil {
-		return false, err
+		return WebhookEvent{}, err
 	}
 
-	_, ok := db.RevokedTokens[token]
-	return ok, nil
+	event, ok := db.WebhookEvents[id]
+	if !ok {
+		return WebhookEvent{}, ErrWebhookEventNotFound
+	}
+	return event, nil
 }
 
-func AddRevokedToken(token string) error {
-	db, err := GetDB()
+func CreateWebhookEndpoint(url string, events []string, secret string) (WebhookEndpoint, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
 	if err != nil {
-		return err
+		return WebhookEndpoint{}, err
 	}
 
-	db.RevokedTokens[token] = true
+	now := time.Now().UTC()
+	endpoint := WebhookEndpoint{
+		Id: db.allocateId("webhookEndpoints", maxId(db.WebhookEndpoints)),
+		Url: url,
+		Events: events,
+		Secret: secret,
+		Active: true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	db.WebhookEndpoints[endpoint.Id] = endpoint
+
 	err = saveDB(db)
-	return err
+	return endpoint, err
+}
+
+func UpdateWebhookEndpoint(id int, update WebhookEndpointUpdate) (WebhookEndpoint, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	endpoint, ok := db.WebhookEndpoints[id]
+	if !ok {
+		return WebhookEndpoint{}, ErrWebhookEndpointNotFound
+	}
+
+	if update.Url != nil {
+		endpoint.Url = *update.Url
+	}
+	if update.Events != nil {
+		endpoint.Events = update.Events
+	}
+	if update.Active != nil {
+		endpoint.Active = *update.Active
+	}
+	endpoint.UpdatedAt = time.Now().UTC()
+	db.WebhookEndpoints[id] = endpoint
+
+	err = saveDB(db)
+	return endpoint, err
+}
+
+// DeleteWebhookEndpoint removes an endpoint. Its deliveries stay in the
+// log, the pending ones are dead lettered.
+func DeleteWebhookEndpoint(id int) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return err
+	}
+
+	_, ok := db.WebhookEndpoints[id]
+	if !ok {
+		return ErrWebhookEndpointNotFound
+	}
+	delete(db.WebhookEndpoints, id)
+
+	for deliveryId, delivery := range db.WebhookDeliveries {
+		if delivery.EndpointId == id && delivery.Status == WebhookDeliveryPending {
+			delivery.Status = WebhookDeliveryDead
+			delivery.NextAttemptAt = nil
+			db.WebhookDeliveries[deliveryId] = delivery
+		}
+	}
+
+	return saveDB(db)
+}
+
+// QueueWebhookDeliveries queues an event for every active endpoint that
+// subscribed to it, and drops finished deliveries past their retention.
+func QueueWebhookDeliveries(eventId, event, payload string, now time.Time) ([]WebhookDelivery, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	now = now.UTC()
+	for id, delivery := range db.WebhookDeliveries {
+		if delivery.Status != WebhookDeliveryPending && now.Sub(delivery.CreatedAt) > webhookEventRetention {
+			delete(db.WebhookDeliveries, id)
+		}
+	}
+
+	endpointIds := []int{}
+	for id, endpoint := range db.WebhookEndpoints {
+		if endpoint.Active && slices.Contains(endpoint.Events, event) {
+			endpointIds = append(endpointIds, id)
+		}
+	}
+	sort.Ints(endpointIds)
+
+	deliveries := []WebhookDelivery{}
+	for _, endpointId := range endpointIds {
+		delivery := WebhookDelivery{
+			Id: db.allocateId("webhookDeliveries", maxId(db.WebhookDeliveries)),
+			EndpointId: endpointId,
+			EventId: eventId,
+			Event: event,
+			Payload: payload,
+			Status: WebhookDeliveryPending,
+			Attempts: []WebhookDeliveryAttempt{},
+			NextAttemptAt: &now,
+			CreatedAt: now,
+		}
+		db.WebhookDeliveries[delivery.Id] = delivery
+		deliveries = append(deliveries, delivery)
+	}
+
+	err = saveDB(db)
+	return deliveries, err
+}
+
+// DueWebhookDeliveries returns the pending deliveries due by now, oldest
+// first, along with the endpoints to send them to.
+func DueWebhookDeliveries(now time.Time) ([]WebhookDelivery, map[int]WebhookEndpoint, error) {
+	db, err := GetDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range db.WebhookDeliveries {
+		if delivery.Status != WebhookDeliveryPending || delivery.NextAttemptAt == nil || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		if _, ok := db.WebhookEndpoints[delivery.EndpointId]; ok {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Id < deliveries[j].Id
+	})
+
+	return deliveries, db.WebhookEndpoints, nil
+}
+
+// RecordWebhookDeliveryAttempt adds an attempt to a delivery. A failed
+// attempt is retried at retryAt, a zero retryAt dead letters the delivery.
+func RecordWebhookDeliveryAttempt(id int, attempt WebhookDeliveryAttempt, retryAt time.Time) (WebhookDelivery, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	delivery, ok := db.WebhookDeliveries[id]
+	if !ok {
+		return WebhookDelivery{}, ErrWebhookDeliveryNotFound
+	}
+
+	attempt.At = attempt.At.UTC()
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	delivery.NextAttemptAt = nil
+	switch {
+	case attempt.Succeeded():
+		delivery.Status = WebhookDeliveryDelivered
+		delivery.DeliveredAt = &attempt.At
+	case retryAt.IsZero():
+		delivery.Failures++
+		delivery.Status = WebhookDeliveryDead
+	default:
+		delivery.Failures++
+		retryAt = retryAt.UTC()
+		delivery.NextAttemptAt = &retryAt
+	}
+	db.WebhookDeliveries[id] = delivery
+
+	err = saveDB(db)
+	return delivery, err
+}
+
+// RequeueWebhookDelivery queues a delivery to be sent again right away,
+// with its failures forgotten
+func RequeueWebhookDelivery(id int, now time.Time) (WebhookDelivery, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	delivery, ok := db.WebhookDeliveries[id]
+	if !ok {
+		return WebhookDelivery{}, ErrWebhookDeliveryNotFound
+	}
+	if _, ok := db.WebhookEndpoints[delivery.EndpointId]; !ok {
+		return WebhookDelivery{}, ErrWebhookEndpointNotFound
+	}
+
+	now = now.UTC()
+	delivery.Status = WebhookDeliveryPending
+	delivery.Failures = 0
+	delivery.NextAttemptAt = &now
+	db.WebhookDeliveries[id] = delivery
+
+	err = saveDB(db)
+	return delivery, err
+}
+
+// dropEmailVerifications deletes the user's email verification tokens for
+// addresses other than their current one
+func (db *Database) dropEmailVerifications(user User) {
+	for hash, token := range db.OneTimeTokens {
+		if token.UserId == user.Id && token.Purpose == TokenPurposeEmailVerification && token.Email != user.Email {
+			delete(db.OneTimeTokens, hash)
+		}
+	}
+}
+
+// VerifyUserEmail marks email as verified and makes it the user's address,
+// which is how a pending email change gets applied. It fails with
+// ErrEmailNotPending for an address the user has since replaced.
+func VerifyUserEmail(id int, email string) (User, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return User{}, err
+	}
+
+	user, ok := db.Users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if email != user.Email && email != user.PendingEmail {
+		return User{}, ErrEmailNotPending
+	}
+	if emailTaken(db, email, id) {
+		return User{}, ErrEmailTaken
+	}
+
+	user.Email = email
+	user.IsVerified = true
+	if user.PendingEmail == email {
+		user.PendingEmail = ""
+	}
+	user.UpdatedAt = time.Now().UTC()
+	db.Users[id] = user
+	err = saveDB(db)
+	return user, err
+}
+
+func emailTaken(db Database, email string, exceptId int) bool {
+	for _, user := range db.Users {
+		if user.Id != exceptId && user.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedHandles can't be taken by users, they collide with the static
+// routes next to /api/users/{user} or would pass for the service itself.
+var reservedHandles = map[string]bool{
+	"export": true,
+	"verify": true,
+	"resend": true,
+	"me": true,
+	"admin": true,
+	"api": true,
+	"chirpy": true,
+	"support": true,
+}
+
+// ProfileUpdate holds the public profile fields to change, nil fields are
+// left as they are.
+type ProfileUpdate struct {
+	Handle *string
+	DisplayName *string
+	Bio *string
+	AvatarUrl *string
+	// PendingEmail replaces the email waiting for verification, an empty
+	// one cancels the change. Verification tokens sent to the replaced
+	// address stop working.
+	PendingEmail *string
+}
+
+// UpdateUserProfile applies the update, or nothing of it if the handle is
+// reserved or the handle or the email are taken.
+func UpdateUserProfile(id int, update ProfileUpdate) (User, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return User{}, err
+	}
+
+	user, ok := db.Users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	if update.Handle != nil {
+		if reservedHandles[strings.ToLower(*update.Handle)] {
+			return User{}, ErrHandleReserved
+		}
+		for _, other := range db.Users {
+			if other.Id != id && strings.EqualFold(other.Handle, *update.Handle) {
+				return User{}, ErrHandleTaken
+			}
+		}
+		user.Handle = *update.Handle
+	}
+	if update.PendingEmail != nil {
+		if *update.PendingEmail != "" && emailTaken(db, *update.PendingEmail, id) {
+			return User{}, ErrEmailTaken
+		}
+		user.PendingEmail = *update.PendingEmail
+		db.dropEmailVerifications(user)
+	}
+	if update.DisplayName != nil {
+		user.DisplayName = *update.DisplayName
+	}
+	if update.Bio != nil {
+		user.Bio = *update.Bio
+	}
+	if update.AvatarUrl != nil {
+		user.AvatarUrl = *update.AvatarUrl
+	}
+
+	user.UpdatedAt = time.Now().UTC()
+	db.Users[id] = user
+	err = saveDB(db)
+	return user, err
+}
+
+// updateUser applies update to the stored user under the database lock.
+// An error returned by update is passed through and nothing is saved.
+func updateUser(id int, update func(user *User) error) (User, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return User{}, err
+	}
+
+	user, ok := db.Users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	err = update(&user)
+	if err != nil {
+		return User{}, err
+	}
+
+	user.UpdatedAt = time.Now().UTC()
+	db.Users[id] = user
+	err = saveDB(db)
+	return user, err
+}
+
+func SetPendingTotpSecret(id int, secret string) (User, error) {
+	return updateUser(id, func(user *User) error {
+		user.TotpPendingSecret = secret
+		return nil
+	})
+}
+
+// EnableTotp activates the pending secret, step is the one the confirming
+// code was valid for.
+func EnableTotp(id int, step int64, recoveryCodes []string) (User, error) {
+	return updateUser(id, func(user *User) error {
+		if user.TotpPendingSecret == "" {
+			return ErrTotpNotPending
+		}
+		user.TotpEnabled = true
+		user.TotpSecret = user.TotpPendingSecret
+		user.TotpPendingSecret = ""
+		user.TotpLastStep = step
+		user.RecoveryCodes = recoveryCodes
+		return nil
+	})
+}
+
+func DisableTotp(id int) (User, error) {
+	return updateUser(id, func(user *User) error {
+		user.TotpEnabled = false
+		user.TotpSecret = ""
+		user.TotpPendingSecret = ""
+		user.TotpLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// UseTotpStep records that a code for step was accepted. It fails if the
+// step was already used, which can happen with two concurrent logins.
+func UseTotpStep(id int, step int64) (User, error) {
+	return updateUser(id, func(user *User) error {
+		if step <= user.TotpLastStep {
+			return ErrTotpStepUsed
+		}
+		user.TotpLastStep = step
+		return nil
+	})
+}
+
+// UseRecoveryCode removes the recovery code with the given hash.
+func UseRecoveryCode(id int, hash string) (User, error) {
+	return updateUser(id, func(user *User) error {
+		for i, code := range user.RecoveryCodes {
+			if code == hash {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrRecoveryCodeInvalid
+	})
+}
+
+func SetRecoveryCodes(id int, recoveryCodes []string) (User, error) {
+	return updateUser(id, func(user *User) error {
+		user.RecoveryCodes = recoveryCodes
+		return nil
+	})
+}
+
+// SetUserPassword replaces the password hash, hashed by the caller.
+func SetUserPassword(id int, passwordHash string) (User, error) {
+	return updateUser(id, func(user *User) error {
+		user.Password = passwordHash
+		return nil
+	})
+}
+
+// RehashUserPassword replaces oldHash with newHash, a hash of the same
+// password with current parameters. It fails with ErrPasswordChanged if
+// the password was changed since oldHash was read.
+func RehashUserPassword(id int, oldHash, newHash string) (User, error) {
+	return updateUser(id, func(user *User) error {
+		if user.Password != oldHash {
+			return ErrPasswordChanged
+		}
+		user.Password = newHash
+		return nil
+	})
+}
+
+// ResetUserPassword replaces the password hash and ends every session and
+// personal access token of the user, so whoever had access before the
+// reset loses it.
+func ResetUserPassword(id int, passwordHash string) (User, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return User{}, err
+	}
+
+	user, ok := db.Users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	now := time.Now().UTC()
+	user.Password = passwordHash
+	user.UpdatedAt = now
+	db.Users[id] = user
+
+	for sessionId, session := range db.Sessions {
+		if session.UserId == id && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			db.Sessions[sessionId] = session
+		}
+	}
+	for tokenId, token := range db.PersonalAccessTokens {
+		if token.UserId == id {
+			delete(db.PersonalAccessTokens, tokenId)
+		}
+	}
+
+	err = saveDB(db)
+	return user, err
+}
+
+// DeleteChirp deletes a chirp and returns the ids of the chirps removed,
+// which include its rechirps
+func DeleteChirp(id int) ([]int, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	chirp, ok := db.Chirps[id]
+	if !ok || chirp.DeletedAt != nil {
+		return nil, ErrChirpNotFound
+	}
+
+	removed := db.removeChirp(id)
+	err = saveDB(db)
+	if err != nil {
+		return nil, err
+	}
+	if chirpIndex != nil {
+		for _, chirpId := range removed {
+			chirpIndex.Remove(chirpId)
+		}
+	}
+	return removed, nil
+}
+
+// DeleteUser removes the user with everything that belongs to them. Their
+// chirps are deleted too, unless anonymizeChirps is set, in which case
+// they are kept without an author. It returns the ids of the chirps
+// removed, which include rechirps of them by other users.
+func DeleteUser(id int, anonymizeChirps bool) ([]int, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	_, ok := db.Users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	deletedChirps := []int{}
+	for chirpId, chirp := range db.Chirps {
+		if chirp.AuthorId != id {
+			continue
+		}
+		// Rechirps have nothing of their own to keep
+		if anonymizeChirps && chirp.RechirpOfId == 0 {
+			chirp.AuthorId = 0
+			chirp.UpdatedAt = time.Now().UTC()
+			db.Chirps[chirpId] = chirp
+		} else {
+			deletedChirps = append(deletedChirps, chirpId)
+		}
+	}
+	removed := []int{}
+	for _, chirpId := range deletedChirps {
+		removed = append(removed, db.removeChirp(chirpId)...)
+	}
+	for chirpId, likes := range db.ChirpLikes {
+		delete(likes, id)
+		if len(likes) == 0 {
+			delete(db.ChirpLikes, chirpId)
+		}
+	}
+	for followeeId := range db.Follows[id] {
+		db.removeFollow(id, followeeId)
+	}
+	for followerId := range db.Followers[id] {
+		db.removeFollow(followerId, id)
+	}
+	delete(db.Timelines, id)
+	delete(db.Memberships, id)
+	for _, relations := range []map[int]map[int]time.Time{db.Blocks, db.Mutes} {
+		delete(relations, id)
+		for otherId, others := range relations {
+			delete(others, id)
+			if len(others) == 0 {
+				delete(relations, otherId)
+			}
+		}
+	}
+	for tokenId, token := range db.PersonalAccessTokens {
+		if token.UserId == id {
+			delete(db.PersonalAccessTokens, tokenId)
+		}
+	}
+	for hash, token := range db.OneTimeTokens {
+		if token.UserId == id {
+			delete(db.OneTimeTokens, hash)
+		}
+	}
+	for sessionId, session := range db.Sessions {
+		if session.UserId == id {
+			delete(db.Sessions, sessionId)
+		}
+	}
+	delete(db.Users, id)
+
+	err = saveDB(db)
+	if err != nil {
+		return nil, err
+	}
+	if chirpIndex != nil {
+		for _, chirpId := range removed {
+			chirpIndex.Remove(chirpId)
+		}
+	}
+	return removed, nil
+}
+
+// EditChirp replaces the body of a chirp, keeping the previous one as a
+// revision. Editing to the same body changes nothing.
+func EditChirp(id int, body string) (Chirp, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp, ok := db.Chirps[id]
+	if !ok || chirp.DeletedAt != nil {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if chirp.Body == body {
+		return chirp, nil
+	}
+
+	now := time.Now().UTC()
+	revisions := db.ChirpRevisions[id]
+	bodySince := chirp.CreatedAt
+	if chirp.EditedAt != nil {
+		bodySince = *chirp.EditedAt
+	}
+	db.ChirpRevisions[id] = append(revisions, ChirpRevision{
+		Body: chirp.Body,
+		CreatedAt: bodySince,
+		ReplacedAt: now,
+	})
+
+	chirp.Body = body
+	chirp.EditedAt = &now
+	chirp.UpdatedAt = now
+	db.Chirps[id] = chirp
+
+	err = saveDB(db)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirpIndex != nil {
+		chirpIndex.Add(chirp.Id, chirp.Body)
+	}
+	return chirp, nil
+}
+
+// LikeChirp records that the user likes the chirp, liking it again changes
+// nothing. It returns the chirp's like count.
+func LikeChirp(chirpId, userId int) (int, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return 0, err
+	}
+
+	chirp, ok := db.Chirps[chirpId]
+	if !ok || chirp.DeletedAt != nil {
+		return 0, ErrChirpNotFound
+	}
+	if db.IsBlocked(chirp.AuthorId, userId) {
+		return 0, ErrBlocked
+	}
+
+	likes, ok := db.ChirpLikes[chirpId]
+	if !ok {
+		likes = map[int]time.Time{}
+		db.ChirpLikes[chirpId] = likes
+	}
+	if _, liked := likes[userId]; liked {
+		return len(likes), nil
+	}
+
+	likes[userId] = time.Now().UTC()
+	err = saveDB(db)
+	return len(likes), err
+}
+
+// UnlikeChirp removes the user's like if there is one and returns the
+// chirp's like count.
+func UnlikeChirp(chirpId, userId int) (int, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return 0, err
+	}
+
+	chirp, ok := db.Chirps[chirpId]
+	if !ok || chirp.DeletedAt != nil {
+		return 0, ErrChirpNotFound
+	}
+
+	likes := db.ChirpLikes[chirpId]
+	if _, liked := likes[userId]; !liked {
+		return len(likes), nil
+	}
+
+	delete(likes, userId)
+	if len(likes) == 0 {
+		delete(db.ChirpLikes, chirpId)
+	}
+	err = saveDB(db)
+	return len(likes), err
+}
+
+// FollowUser makes follower follow followee, following again changes
+// nothing. The followee's recent chirps are merged into the follower's
+// timeline. It returns the followee's follower count.
+func FollowUser(followerId, followeeId int) (int, error) {
+	if followerId == followeeId {
+		return 0, ErrFollowSelf
+	}
+
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return 0, err
+	}
+
+	_, ok := db.Users[followeeId]
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	if db.IsBlocked(followeeId, followerId) {
+		return 0, ErrBlocked
+	}
+	if _, following := db.Follows[followerId][followeeId]; following {
+		return len(db.Followers[followeeId]), nil
+	}
+
+	now := time.Now().UTC()
+	if db.Follows[followerId] == nil {
+		db.Follows[followerId] = map[int]time.Time{}
+	}
+	db.Follows[followerId][followeeId] = now
+	if db.Followers[followeeId] == nil {
+		db.Followers[followeeId] = map[int]time.Time{}
+	}
+	db.Followers[followeeId][followerId] = now
+
+	timeline := db.Timelines[followerId]
+	for _, chirp := range db.Chirps {
+		if chirp.AuthorId == followeeId && chirp.DeletedAt == nil {
+			timeline = append(timeline, chirp.Id)
+		}
+	}
+	db.Timelines[followerId] = trimTimeline(timeline)
+
+	err = saveDB(db)
+	return len(db.Followers[followeeId]), err
+}
+
+// UnfollowUser removes the follow if there is one, along with the
+// followee's chirps in the follower's timeline. It returns the followee's
+// follower count.
+func UnfollowUser(followerId, followeeId int) (int, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return 0, err
+	}
+
+	_, ok := db.Users[followeeId]
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	if _, following := db.Follows[followerId][followeeId]; !following {
+		return len(db.Followers[followeeId]), nil
+	}
+
+	db.removeFollow(followerId, followeeId)
+	err = saveDB(db)
+	return len(db.Followers[followeeId]), err
+}
+
+func (db *Database) removeFollow(followerId, followeeId int) {
+	delete(db.Follows[followerId], followeeId)
+	if len(db.Follows[followerId]) == 0 {
+		delete(db.Follows, followerId)
+	}
+	delete(db.Followers[followeeId], followerId)
+	if len(db.Followers[followeeId]) == 0 {
+		delete(db.Followers, followeeId)
+	}
+
+	timeline := db.Timelines[followerId]
+	kept := timeline[:0]
+	for _, chirpId := range timeline {
+		chirp, ok := db.Chirps[chirpId]
+		if ok && chirp.AuthorId != followeeId {
+			kept = append(kept, chirpId)
+		}
+	}
+	if len(kept) == 0 {
+		delete(db.Timelines, followerId)
+	} else {
+		db.Timelines[followerId] = kept
+	}
+}
+
+// IsBlocked reports whether blocker blocked user
+func (db Database) IsBlocked(blockerId, userId int) bool {
+	_, blocked := db.Blocks[blockerId][userId]
+	return blocked
+}
+
+// IsMuted reports whether muter muted user
+func (db Database) IsMuted(muterId, userId int) bool {
+	_, muted := db.Mutes[muterId][userId]
+	return muted
+}
+
+// BlockUser blocks the user for blocker, which also ends the follows
+// between them in both directions.
+func BlockUser(blockerId, userId int) error {
+	return setRelation(blockerId, userId, true, func(db *Database) map[int]map[int]time.Time {
+		db.removeFollow(blockerId, userId)
+		db.removeFollow(userId, blockerId)
+		return db.Blocks
+	})
+}
+
+func UnblockUser(blockerId, userId int) error {
+	return setRelation(blockerId, userId, false, func(db *Database) map[int]map[int]time.Time {
+		return db.Blocks
+	})
+}
+
+func MuteUser(muterId, userId int) error {
+	return setRelation(muterId, userId, true, func(db *Database) map[int]map[int]time.Time {
+		return db.Mutes
+	})
+}
+
+func UnmuteUser(muterId, userId int) error {
+	return setRelation(muterId, userId, false, func(db *Database) map[int]map[int]time.Time {
+		return db.Mutes
+	})
+}
+
+// setRelation adds or removes the relation from one user to another in the
+// table returned by table, which can also make other changes to db.
+// Setting a relation that is already there changes nothing.
+func setRelation(fromId, toId int, on bool, table func(db *Database) map[int]map[int]time.Time) error {
+	if fromId == toId {
+		return ErrRelationSelf
+	}
+
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return err
+	}
+
+	_, ok := db.Users[toId]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	relations := table(&db)
+	_, exists := relations[fromId][toId]
+	if on == exists {
+		return nil
+	}
+
+	if on {
+		if relations[fromId] == nil {
+			relations[fromId] = map[int]time.Time{}
+		}
+		relations[fromId][toId] = time.Now().UTC()
+	} else {
+		delete(relations[fromId], toId)
+		if len(relations[fromId]) == 0 {
+			delete(relations, fromId)
+		}
+	}
+	return saveDB(db)
+}
+
+func SaveSession(userId int, tokenHash, ipAddress, userAgent string, expiresAt time.Time) (Session, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now().UTC()
+	for sessionId, session := range db.Sessions {
+		if now.After(session.ExpiresAt) {
+			delete(db.Sessions, sessionId)
+		}
+	}
+
+	session := Session{
+		Id: db.allocateId("sessions", maxId(db.Sessions)),
+		UserId: userId,
+		TokenHash: tokenHash,
+		IpAddress: ipAddress,
+		UserAgent: userAgent,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	db.Sessions[session.Id] = session
+	err = saveDB(db)
+	return session, err
+}
+
+// RevokeSession marks the session of the refresh token as revoked, if
+// the token belongs to one.
+func RevokeSession(tokenHash string) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for sessionId, session := range db.Sessions {
+		if session.TokenHash == tokenHash && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			db.Sessions[sessionId] = session
+			return saveDB(db)
+		}
+	}
+	return nil
+}
+
+// SessionRevoked reports whether the session of the refresh token was
+// revoked. Tokens without a session predate sessions and are not.
+func SessionRevoked(tokenHash string) (bool, error) {
+	db, err := GetDB()
+	if err != nil {
+		return false, err
+	}
+
+	for _, session := range db.Sessions {
+		if session.TokenHash == tokenHash {
+			return session.RevokedAt != nil, nil
+		}
+	}
+	return false, nil
+}
+
+func RevokedTokenExists(token string) (bool, error) {
+	db, err := GetDB()
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := db.RevokedTokens[token]
+	return ok, nil
+}
+
+func AddRevokedToken(token string) error {
+	db, err := GetDB()
+	if err != nil {
+		return err
+	}
+
+	db.RevokedTokens[token] = true
+	err = saveDB(db)
+	return err
+}
+
+func SavePersonalAccessToken(userId int, name, hash string, scopes []string, expiresAt *time.Time) (PersonalAccessToken, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+
+	token := PersonalAccessToken{
+		Id: db.allocateId("personalAccessTokens", maxId(db.PersonalAccessTokens)),
+		UserId: userId,
+		Name: name,
+		Hash: hash,
+		Scopes: scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	db.PersonalAccessTokens[token.Id] = token
+	err = saveDB(db)
+
+	return token, err
+}
+
+func GetPersonalAccessTokenByHash(hash string) (PersonalAccessToken, error) {
+	db, err := GetDB()
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+
+	for _, token := range db.PersonalAccessTokens {
+		if token.Hash == hash {
+			return token, nil
+		}
+	}
+	return PersonalAccessToken{}, ErrTokenNotFound
+}
+
+func ListPersonalAccessTokens(userId int) ([]PersonalAccessToken, error) {
+	db, err := GetDB()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []PersonalAccessToken{}
+	for _, token := range db.PersonalAccessTokens {
+		if token.UserId == userId {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func DeletePersonalAccessToken(userId, id int) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return err
+	}
+
+	token, ok := db.PersonalAccessTokens[id]
+	if !ok || token.UserId != userId {
+		return ErrTokenNotFound
+	}
+
+	delete(db.PersonalAccessTokens, id)
+	return saveDB(db)
+}
+
+// SaveOneTimeToken stores token and drops the user's earlier tokens with the
+// same purpose, so only the most recently mailed one stays usable.
+// Expired tokens of any user are pruned along the way.
+func SaveOneTimeToken(token OneTimeToken) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for hash, existing := range db.OneTimeTokens {
+		sameKind := existing.UserId == token.UserId && existing.Purpose == token.Purpose
+		if sameKind || now.After(existing.ExpiresAt) {
+			delete(db.OneTimeTokens, hash)
+		}
+	}
+
+	db.OneTimeTokens[token.Hash] = token
+	return saveDB(db)
+}
+
+// ConsumeOneTimeToken marks the token as used and returns it, failing if it
+// does not exist for purpose, has expired or was already used.
+func ConsumeOneTimeToken(hash, purpose string) (OneTimeToken, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+
+	token, ok := db.OneTimeTokens[hash]
+	if !ok || token.Purpose != purpose {
+		return OneTimeToken{}, ErrTokenNotFound
+	}
+	if token.UsedAt != nil {
+		return OneTimeToken{}, ErrTokenUsed
+	}
+	now := time.Now().UTC()
+	if now.After(token.ExpiresAt) {
+		return OneTimeToken{}, ErrTokenExpired
+	}
+
+	token.UsedAt = &now
+	db.OneTimeTokens[hash] = token
+	err = saveDB(db)
+	return token, err
+}
+
+// SearchChirps runs query against the chirp index. The database is
+// returned along with the results so they can be looked up consistently.
+func SearchChirps(query search.Query) ([]search.Result, Database, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db, err := loadDB()
+	if err != nil {
+		return nil, db, err
+	}
+
+	if chirpIndex == nil {
+		chirpIndex = search.NewIndex()
+		for _, chirp := range db.Chirps {
+			if chirp.DeletedAt == nil {
+				chirpIndex.Add(chirp.Id, chirp.Body)
+			}
+		}
+	}
+
+	return chirpIndex.Search(query), db, nil
 }
 
 func GetDB() (Database, error) {
@@ -0,0 +1,186 @@
+// Package password hashes and verifies user passwords and checks new
+// passwords against the configured policy.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Algorithm string
+
+const Bcrypt Algorithm = "bcrypt"
+const Argon2id Algorithm = "argon2id"
+
+// bcryptMaxBytes is the longest password bcrypt can hash
+const bcryptMaxBytes = 72
+const argon2SaltSize = 16
+const argon2KeySize = 32
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+type Params struct {
+	Algorithm Algorithm
+	BcryptCost int
+	// Argon2Memory is in KiB
+	Argon2Memory uint32
+	Argon2Iterations uint32
+	Argon2Parallelism uint8
+}
+
+func DefaultParams() Params {
+	return Params{
+		Algorithm: Bcrypt,
+		BcryptCost: 10,
+		Argon2Memory: 64 * 1024,
+		Argon2Iterations: 1,
+		Argon2Parallelism: 4,
+	}
+}
+
+type Hasher struct {
+	params Params
+	dummyHash string
+}
+
+func NewHasher(params Params) (*Hasher, error) {
+	switch params.Algorithm {
+	case Bcrypt:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+		if params.Argon2Memory == 0 || params.Argon2Iterations == 0 || params.Argon2Parallelism == 0 {
+			return nil, errors.New("argon2id memory, iterations and parallelism must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm: %s", params.Algorithm)
+	}
+
+	h := &Hasher{params: params}
+	dummyHash, err := h.Hash("not-a-real-password")
+	if err != nil {
+		return nil, err
+	}
+	h.dummyHash = dummyHash
+	return h, nil
+}
+
+// MaxPasswordBytes is the longest password the configured algorithm accepts.
+func (h *Hasher) MaxPasswordBytes() int {
+	if h.params.Algorithm == Bcrypt {
+		return bcryptMaxBytes
+	}
+	return 1024
+}
+
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.params.Algorithm == Argon2id {
+		salt := make([]byte, argon2SaltSize)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		return encodeArgon2id(h.params, salt, password), nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.params.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify reports whether password matches hash, and if it does, whether
+// hash should be replaced because it was made with other parameters.
+func (h *Hasher) Verify(hash, password string) (bool, bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, false, err
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Argon2Iterations, params.Argon2Memory, params.Argon2Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false, nil
+		}
+		needsRehash := h.params.Algorithm != Argon2id ||
+			params.Argon2Memory != h.params.Argon2Memory ||
+			params.Argon2Iterations != h.params.Argon2Iterations ||
+			params.Argon2Parallelism != h.params.Argon2Parallelism
+		return true, needsRehash, nil
+	}
+
+	if strings.HasPrefix(hash, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return false, false, err
+		}
+		needsRehash := h.params.Algorithm != Bcrypt || cost != h.params.BcryptCost
+		return true, needsRehash, nil
+	}
+
+	return false, false, ErrUnknownHash
+}
+
+// DummyVerify does the same work as verifying a real password, for
+// requests about accounts that don't exist to take as long as the rest.
+func (h *Hasher) DummyVerify(password string) {
+	h.Verify(h.dummyHash, password)
+}
+
+func encodeArgon2id(params Params, salt []byte, password string) string {
+	key := argon2.IDKey([]byte(password), salt, params.Argon2Iterations, params.Argon2Memory, params.Argon2Parallelism, argon2KeySize)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Argon2Memory,
+		params.Argon2Iterations,
+		params.Argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func decodeArgon2id(hash string) (Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return Params{}, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Params{}, nil, nil, ErrUnknownHash
+	}
+
+	params := Params{Algorithm: Argon2id}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Iterations, &params.Argon2Parallelism)
+	if err != nil {
+		return Params{}, nil, nil, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Params{}, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Params{}, nil, nil, ErrUnknownHash
+	}
+
+	return params, salt, key, nil
+}
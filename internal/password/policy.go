@@ -0,0 +1,81 @@
+package password
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// commonPasswords is a short list of the most used passwords, it is always
+// part of the breached list even when no file is configured
+//go:embed common_passwords.txt
+var commonPasswords string
+
+// PolicyError is a password the policy rejects, its message is meant for the user.
+type PolicyError struct {
+	message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.message
+}
+
+type Policy struct {
+	minLength int
+	maxBytes int
+	breached map[string]struct{}
+}
+
+// NewPolicy creates a policy with the given length limits. breachedListPath
+// is an optional file with one known breached password per line.
+func NewPolicy(minLength, maxBytes int, breachedListPath string) (*Policy, error) {
+	p := &Policy{
+		minLength: minLength,
+		maxBytes: maxBytes,
+		breached: map[string]struct{}{},
+	}
+
+	p.addBreached(strings.NewReader(commonPasswords))
+	if breachedListPath != "" {
+		file, err := os.Open(breachedListPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		err = p.addBreached(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Policy) addBreached(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			p.breached[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// Validate returns a *PolicyError if password is not acceptable for a new password.
+func (p *Policy) Validate(password string) error {
+	if utf8.RuneCountInString(password) < p.minLength {
+		return &PolicyError{fmt.Sprintf("Password must be at least %d characters long", p.minLength)}
+	}
+	if len(password) > p.maxBytes {
+		return &PolicyError{fmt.Sprintf("Password must be at most %d bytes long", p.maxBytes)}
+	}
+	if _, ok := p.breached[strings.ToLower(password)]; ok {
+		return &PolicyError{"Password is too common or appeared in a data breach, choose another one"}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Package pubsub is an in-memory publish/subscribe bus. Recent messages are
+// kept in a bounded buffer so subscribers can resume after a reconnect, and
+// subscribers that fall behind are dropped instead of slowing publishers.
+package pubsub
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrSlowConsumer = errors.New("subscriber fell too far behind")
+var ErrClosed = errors.New("subscription closed")
+
+// Message is a published value with its id. Ids increase by one with every
+// message and start over when the process restarts.
+type Message[T any] struct {
+	Id uint64
+	Value T
+}
+
+type Bus[T any] struct {
+	mu sync.Mutex
+	lastId uint64
+	// buffer holds the most recent messages, oldest first
+	buffer []Message[T]
+	bufferSize int
+	queueSize int
+	subscribers map[*Subscription[T]]bool
+}
+
+// New returns a bus keeping the last bufferSize messages for resuming
+// subscribers. Subscribers may have queueSize messages waiting before they
+// are dropped.
+func New[T any](bufferSize, queueSize int) *Bus[T] {
+	return &Bus[T]{
+		buffer: make([]Message[T], 0, bufferSize),
+		bufferSize: bufferSize,
+		queueSize: queueSize,
+		subscribers: map[*Subscription[T]]bool{},
+	}
+}
+
+// Publish sends value to every subscriber whose filter accepts it and
+// returns the id of the message. It never blocks, subscribers with a full
+// queue are dropped with ErrSlowConsumer.
+func (b *Bus[T]) Publish(value T) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastId++
+	message := Message[T]{Id: b.lastId, Value: value}
+	if len(b.buffer) == b.bufferSize {
+		copy(b.buffer, b.buffer[1:])
+		b.buffer = b.buffer[:len(b.buffer)-1]
+	}
+	b.buffer = append(b.buffer, message)
+
+	for sub := range b.subscribers {
+		if sub.filter != nil && !sub.filter(value) {
+			continue
+		}
+		select {
+		case sub.c <- message:
+		default:
+			b.drop(sub, ErrSlowConsumer)
+		}
+	}
+
+	return message.Id
+}
+
+// Subscribe starts receiving messages accepted by filter, a nil filter
+// accepts everything. With a non-zero afterId the buffered messages after
+// it are delivered first. If some of those are no longer buffered, or the
+// id is from before a restart, Missed reports it.
+func (b *Bus[T]) Subscribe(afterId uint64, filter func(T) bool) *Subscription[T] {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	replay := []Message[T]{}
+	missed := false
+	if afterId != 0 {
+		if afterId > b.lastId {
+			missed = true
+		} else if len(b.buffer) > 0 && afterId+1 < b.buffer[0].Id {
+			missed = true
+		}
+		for _, message := range b.buffer {
+			if message.Id > afterId && (filter == nil || filter(message.Value)) {
+				replay = append(replay, message)
+			}
+		}
+	}
+
+	sub := &Subscription[T]{
+		bus: b,
+		c: make(chan Message[T], b.queueSize+len(replay)),
+		filter: filter,
+		missed: missed,
+	}
+	for _, message := range replay {
+		sub.c <- message
+	}
+	b.subscribers[sub] = true
+	return sub
+}
+
+// drop ends a subscription, b.mu must be held
+func (b *Bus[T]) drop(sub *Subscription[T], err error) {
+	if sub.err != nil {
+		return
+	}
+	sub.err = err
+	delete(b.subscribers, sub)
+	close(sub.c)
+}
+
+type Subscription[T any] struct {
+	bus *Bus[T]
+	c chan Message[T]
+	filter func(T) bool
+	missed bool
+	// err is why the subscription ended, guarded by bus.mu
+	err error
+}
+
+// C delivers the messages. It is closed when the subscription ends, Err
+// then says why.
+func (s *Subscription[T]) C() <-chan Message[T] {
+	return s.c
+}
+
+// Missed reports whether messages after the id passed to Subscribe were
+// lost, in which case the subscriber should start over.
+func (s *Subscription[T]) Missed() bool {
+	return s.missed
+}
+
+func (s *Subscription[T]) Err() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	return s.err
+}
+
+func (s *Subscription[T]) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	s.bus.drop(s, ErrClosed)
+}
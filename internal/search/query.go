@@ -0,0 +1,70 @@
+package search
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrEmptyQuery = errors.New("query has no words to search for")
+var ErrUnterminatedPhrase = errors.New("query has an unterminated phrase")
+
+// clause is a single term, a term prefix or a phrase of consecutive terms
+type clause struct {
+	terms []string
+	prefix bool
+}
+
+// Query is a parsed search query, a document must match all its clauses.
+type Query struct {
+	clauses []clause
+}
+
+// ParseQuery parses words, "quoted phrases" and prefixes ending in *.
+// Words that tokenize into several terms, like "e-mail", are treated as
+// phrases.
+func ParseQuery(raw string) (Query, error) {
+	query := Query{}
+
+	rest := raw
+	for {
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			break
+		}
+
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return Query{}, ErrUnterminatedPhrase
+			}
+			query.add(Tokenize(rest[1:end+1]), false)
+			rest = rest[end+2:]
+			continue
+		}
+
+		end := strings.IndexAny(rest, " \t\n\"")
+		if end < 0 {
+			end = len(rest)
+		}
+		word := rest[:end]
+		rest = rest[end:]
+
+		prefix := strings.HasSuffix(word, "*")
+		query.add(Tokenize(strings.TrimRight(word, "*")), prefix)
+	}
+
+	if len(query.clauses) == 0 {
+		return Query{}, ErrEmptyQuery
+	}
+	return query, nil
+}
+
+func (q *Query) add(terms []string, prefix bool) {
+	if len(terms) == 0 {
+		return
+	}
+	q.clauses = append(q.clauses, clause{
+		terms: terms,
+		prefix: prefix && len(terms) == 1,
+	})
+}
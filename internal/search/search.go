@@ -0,0 +1,208 @@
+// Package search is an in-memory inverted index over short documents with
+// BM25 ranking, phrase and prefix queries.
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters, the usual defaults
+const k1 = 1.2
+const b = 0.75
+
+// Tokenize splits text into lowercase words. Anything that isn't a letter
+// or a digit separates words.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+type Result struct {
+	Id int
+	Score float64
+}
+
+type Index struct {
+	mu sync.RWMutex
+	// postings maps a term to the documents containing it and the
+	// positions it appears at
+	postings map[string]map[int][]int
+	// terms are the distinct terms of each document, used for removal
+	terms map[int][]string
+	lengths map[int]int
+	totalLength int
+}
+
+func NewIndex() *Index {
+	return &Index{
+		postings: map[string]map[int][]int{},
+		terms: map[int][]string{},
+		lengths: map[int]int{},
+	}
+}
+
+// Add indexes text under id, replacing what was indexed for it before.
+func (ix *Index) Add(id int, text string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(id)
+
+	tokens := Tokenize(text)
+	distinct := []string{}
+	for position, token := range tokens {
+		docs, ok := ix.postings[token]
+		if !ok {
+			docs = map[int][]int{}
+			ix.postings[token] = docs
+		}
+		if _, seen := docs[id]; !seen {
+			distinct = append(distinct, token)
+		}
+		docs[id] = append(docs[id], position)
+	}
+
+	ix.terms[id] = distinct
+	ix.lengths[id] = len(tokens)
+	ix.totalLength += len(tokens)
+}
+
+func (ix *Index) Remove(id int) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(id)
+}
+
+func (ix *Index) remove(id int) {
+	length, ok := ix.lengths[id]
+	if !ok {
+		return
+	}
+
+	for _, term := range ix.terms[id] {
+		docs := ix.postings[term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	delete(ix.terms, id)
+	delete(ix.lengths, id)
+	ix.totalLength -= length
+}
+
+// Search returns the documents matching every clause of the query, best
+// first. Documents with equal scores are ordered newest (highest id) first.
+func (ix *Index) Search(query Query) []Result {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if len(ix.lengths) == 0 {
+		return []Result{}
+	}
+
+	var scores map[int]float64
+	for _, c := range query.clauses {
+		clauseScores := ix.matchClause(c)
+		if scores == nil {
+			scores = clauseScores
+			continue
+		}
+		for id, score := range scores {
+			clauseScore, ok := clauseScores[id]
+			if !ok {
+				delete(scores, id)
+				continue
+			}
+			scores[id] = score + clauseScore
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, Result{Id: id, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Id > results[j].Id
+	})
+	return results
+}
+
+// matchClause returns the BM25 score of every document matching c
+func (ix *Index) matchClause(c clause) map[int]float64 {
+	scores := map[int]float64{}
+
+	if c.prefix {
+		for term, docs := range ix.postings {
+			if !strings.HasPrefix(term, c.terms[0]) {
+				continue
+			}
+			for id, positions := range docs {
+				scores[id] += ix.termScore(term, id, len(positions))
+			}
+		}
+		return scores
+	}
+
+	first, ok := ix.postings[c.terms[0]]
+	if !ok {
+		return scores
+	}
+	for id := range first {
+		if len(c.terms) > 1 && !ix.hasPhrase(id, c.terms) {
+			continue
+		}
+		score := 0.0
+		for _, term := range c.terms {
+			score += ix.termScore(term, id, len(ix.postings[term][id]))
+		}
+		scores[id] = score
+	}
+	return scores
+}
+
+// hasPhrase reports whether terms appear next to each other in document id
+func (ix *Index) hasPhrase(id int, terms []string) bool {
+	for _, start := range ix.postings[terms[0]][id] {
+		matched := true
+		for offset, term := range terms[1:] {
+			if !containsPosition(ix.postings[term][id], start+offset+1) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPosition(positions []int, position int) bool {
+	i := sort.SearchInts(positions, position)
+	return i < len(positions) && positions[i] == position
+}
+
+func (ix *Index) termScore(term string, id int, frequency int) float64 {
+	if frequency == 0 {
+		return 0
+	}
+
+	documents := float64(len(ix.lengths))
+	containing := float64(len(ix.postings[term]))
+	idf := math.Log(1 + (documents-containing+0.5)/(containing+0.5))
+
+	averageLength := float64(ix.totalLength) / documents
+	tf := float64(frequency)
+	norm := 1 - b + b*float64(ix.lengths[id])/averageLength
+	return idf * tf * (k1 + 1) / (tf + k1*norm)
+}
@@ -0,0 +1,379 @@
+// Package websocket is the server side of the WebSocket protocol, RFC 6455,
+// on top of net/http. It covers what the API needs: the handshake, text and
+// binary messages with fragmentation, and ping, pong and close frames.
+// Extensions and subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// acceptGuid is appended to the client key to compute the accept header
+const acceptGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+type MessageType int
+
+const TextMessage MessageType = 1
+const BinaryMessage MessageType = 2
+
+const opContinuation = 0
+const opText = 1
+const opBinary = 2
+const opClose = 8
+const opPing = 9
+const opPong = 10
+
+// maxControlPayload is the largest payload control frames may have
+const maxControlPayload = 125
+
+// Close codes, see RFC 6455 section 7.4.1
+const CloseNormal = 1000
+const CloseGoingAway = 1001
+const CloseProtocolError = 1002
+const CloseUnsupportedData = 1003
+const CloseNoStatus = 1005
+const CloseInvalidPayload = 1007
+const ClosePolicyViolation = 1008
+const CloseMessageTooBig = 1009
+const CloseInternalError = 1011
+
+const defaultReadLimit = 1 << 20
+
+var ErrBadHandshake = errors.New("not a WebSocket handshake")
+var ErrCloseSent = errors.New("close frame already sent")
+
+// CloseError ends a connection, either because the peer closed it or
+// because it broke the protocol
+type CloseError struct {
+	Code int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed with %d %s", e.Code, e.Reason)
+}
+
+type Conn struct {
+	conn net.Conn
+	reader *bufio.Reader
+	readLimit int64
+	pongHandler func(data []byte)
+
+	// writeLock serializes frames from concurrent writers, control frames
+	// are sent by the reader
+	writeLock sync.Mutex
+	closeSent bool
+}
+
+// headerHasToken reports whether a comma separated header contains token,
+// ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade completes the opening handshake and takes over the connection.
+// When the request isn't a valid handshake an error response is written
+// and ErrBadHandshake returned.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, ErrBadHandshake
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	nonce, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(nonce) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	_, err = conn.Write([]byte(response))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		conn: conn,
+		reader: buffered.Reader,
+		readLimit: defaultReadLimit,
+	}, nil
+}
+
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// SetReadLimit sets the largest message ReadMessage accepts, larger ones
+// close the connection with CloseMessageTooBig
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetPongHandler sets a function called by ReadMessage for every pong
+func (c *Conn) SetPongHandler(handler func(data []byte)) {
+	c.pongHandler = handler
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Close closes the underlying connection without a closing handshake
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+type frame struct {
+	fin bool
+	opcode byte
+	payload []byte
+}
+
+// readFrame reads one frame, allowing at most limit bytes of payload
+func (c *Conn) readFrame(limit int64) (frame, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return frame{}, err
+	}
+
+	f := frame{
+		fin: header[0]&0x80 != 0,
+		opcode: header[0] & 0x0f,
+	}
+	if header[0]&0x70 != 0 {
+		return frame{}, &CloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+	}
+	// Clients must mask every frame, section 5.1
+	if header[1]&0x80 == 0 {
+		return frame{}, &CloseError{Code: CloseProtocolError, Reason: "frame not masked"}
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return frame{}, err
+	}
+
+	if f.opcode >= opClose && (!f.fin || length > maxControlPayload) {
+		return frame{}, &CloseError{Code: CloseProtocolError, Reason: "invalid control frame"}
+	}
+	if f.opcode < opClose && length > uint64(limit) {
+		return frame{}, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	mask := make([]byte, 4)
+	_, err = io.ReadFull(c.reader, mask)
+	if err != nil {
+		return frame{}, err
+	}
+	f.payload = make([]byte, length)
+	_, err = io.ReadFull(c.reader, f.payload)
+	if err != nil {
+		return frame{}, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+
+	return f, nil
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// and pongs passed to the pong handler along the way. When the peer closes
+// the connection, or breaks the protocol, the close frame is sent back and
+// a *CloseError returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var messageType MessageType
+	var message []byte
+	started := false
+
+	for {
+		f, err := c.readFrame(c.readLimit - int64(len(message)))
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		switch f.opcode {
+		case opPing:
+			err = c.writeFrame(opPong, f.payload)
+			if err != nil && !errors.Is(err, ErrCloseSent) {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.pongHandler != nil {
+				c.pongHandler(f.payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opContinuation:
+			if !started {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "unexpected continuation frame"})
+			}
+		case opText, opBinary:
+			if started {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "expected continuation frame"})
+			}
+			started = true
+			messageType = MessageType(f.opcode)
+		default:
+			return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "unknown opcode"})
+		}
+
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8"})
+		}
+		return messageType, message, nil
+	}
+}
+
+// handleClose answers a close frame from the peer with the same code
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	if len(payload) == 1 {
+		return c.fail(&CloseError{Code: CloseProtocolError, Reason: "invalid close frame"})
+	}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) || !utf8.ValidString(closeErr.Reason) {
+			return c.fail(&CloseError{Code: CloseProtocolError, Reason: "invalid close frame"})
+		}
+	}
+
+	replyCode := closeErr.Code
+	if replyCode == CloseNoStatus {
+		replyCode = CloseNormal
+	}
+	c.WriteClose(replyCode, "")
+	return closeErr
+}
+
+// validCloseCode reports whether a peer may send code, section 7.4
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code >= 1000 && code <= 1011:
+		return code != 1004 && code != CloseNoStatus && code != 1006
+	}
+	return false
+}
+
+// fail sends a close frame for protocol errors before returning err
+func (c *Conn) fail(err error) error {
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		c.WriteClose(closeErr.Code, closeErr.Reason)
+	}
+	return err
+}
+
+// WriteMessage sends a message in a single frame
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return errors.New("unsupported message type")
+	}
+	return c.writeFrame(byte(messageType), data)
+}
+
+func (c *Conn) WritePing(data []byte) error {
+	return c.writeFrame(opPing, data)
+}
+
+// WriteClose starts or completes the closing handshake. Nothing can be
+// written after it.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(opClose, payload)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	// Server frames are never masked
+	header := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+
+	_, err := c.conn.Write(append(header, payload...))
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+// Failed logins are tracked per account and per client IP. After the free
+// attempts every further failure locks the key for twice as long as the
+// previous one, up to loginMaxDelay. Keys are forgotten after
+// loginResetAfter without failures.
+const loginAccountFreeAttempts = 5
+const loginIpFreeAttempts = 20
+const loginBaseDelay = time.Second
+const loginMaxDelay = 15 * time.Minute
+const loginResetAfter = time.Hour
+
+// loginLimiterSweepSize is how many keys are kept before stale ones are pruned
+const loginLimiterSweepSize = 10000
+
+type loginAttempts struct {
+	failures int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type loginLimiter struct {
+	lock sync.Mutex
+	attempts map[string]*loginAttempts
+	freeAttempts int
+}
+
+func newLoginLimiter(freeAttempts int) *loginLimiter {
+	return &loginLimiter{
+		attempts: map[string]*loginAttempts{},
+		freeAttempts: freeAttempts,
+	}
+}
+
+// lockedFor returns how long key stays locked, zero if it isn't.
+func (l *loginLimiter) lockedFor(key string, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	attempts, ok := l.attempts[key]
+	if !ok || !now.Before(attempts.lockedUntil) {
+		return 0
+	}
+	return attempts.lockedUntil.Sub(now)
+}
+
+func (l *loginLimiter) fail(key string, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.attempts) >= loginLimiterSweepSize {
+		l.sweep(now)
+	}
+
+	attempts, ok := l.attempts[key]
+	if !ok || now.Sub(attempts.lastFailure) > loginResetAfter {
+		attempts = &loginAttempts{}
+		l.attempts[key] = attempts
+	}
+
+	attempts.failures++
+	attempts.lastFailure = now
+	if attempts.failures >= l.freeAttempts {
+		exponent := float64(attempts.failures - l.freeAttempts)
+		delay := time.Duration(float64(loginBaseDelay) * math.Pow(2, exponent))
+		if delay > loginMaxDelay || delay <= 0 {
+			delay = loginMaxDelay
+		}
+		attempts.lockedUntil = now.Add(delay)
+	}
+}
+
+func (l *loginLimiter) reset(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.attempts, key)
+}
+
+func (l *loginLimiter) sweep(now time.Time) {
+	for key, attempts := range l.attempts {
+		if now.Sub(attempts.lastFailure) > loginResetAfter && !now.Before(attempts.lockedUntil) {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+
+// loginGuard combines the per account and per IP limits for the login endpoints.
+type loginGuard struct {
+	accounts *loginLimiter
+	ips *loginLimiter
+}
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{
+		accounts: newLoginLimiter(loginAccountFreeAttempts),
+		ips: newLoginLimiter(loginIpFreeAttempts),
+	}
+}
+
+func loginAccountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (g *loginGuard) lockedFor(email, ip string) time.Duration {
+	now := time.Now()
+	account := g.accounts.lockedFor(loginAccountKey(email), now)
+	address := g.ips.lockedFor(ip, now)
+	if address > account {
+		return address
+	}
+	return account
+}
+
+func (g *loginGuard) fail(email, ip string) {
+	now := time.Now()
+	g.accounts.fail(loginAccountKey(email), now)
+	g.ips.fail(ip, now)
+}
+
+// succeed clears the account's failures. The IP keeps its count, otherwise
+// one valid account would be enough to guess at all the others.
+func (g *loginGuard) succeed(email string) {
+	g.accounts.reset(loginAccountKey(email))
+}
+
+func (g *loginGuard) unlock(email string) {
+	g.accounts.reset(loginAccountKey(email))
+}
+
+func respondWithLoginLocked(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithJsonError(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+
+func handleAdminUsersUnlockPost(w http.ResponseWriter, r *http.Request, guard *loginGuard) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user, err := database.GetUser(id)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	guard.unlock(user.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultOutboxDir = "./outbox"
+
+type mailMessage struct {
+	To string `json:"to"`
+	Subject string `json:"subject"`
+	Body string `json:"body"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+type Mailer interface {
+	Send(message mailMessage) error
+}
+
+// outboxMailer is the default Mailer. Instead of delivering anything it
+// writes every message as a json file into dir, which is enough to run the
+// flows that need mail without an SMTP server.
+type outboxMailer struct {
+	dir string
+	lock sync.Mutex
+	sent int
+}
+
+func newOutboxMailer(dir string) (*outboxMailer, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &outboxMailer{dir: dir}, nil
+}
+
+func (m *outboxMailer) Send(message mailMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if message.SentAt.IsZero() {
+		message.SentAt = time.Now().UTC()
+	}
+
+	dat, err := json.MarshalIndent(message, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	m.sent++
+	name := fmt.Sprintf("%d-%d.json", message.SentAt.UnixNano(), m.sent)
+	return os.WriteFile(filepath.Join(m.dir, name), dat, 0600)
+}
+
+// Messages returns up to limit messages from the outbox, newest first.
+func (m *outboxMailer) Messages(limit int) ([]mailMessage, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	if len(names) > limit {
+		names = names[:limit]
+	}
+
+	messages := make([]mailMessage, 0, len(names))
+	for _, name := range names {
+		raw, err := os.ReadFile(filepath.Join(m.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var message mailMessage
+		err = json.Unmarshal(raw, &message)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+
+func (cfg *apiConfig) handleOutboxGet(w http.ResponseWriter, r *http.Request) {
+	outbox, ok := cfg.mailer.(*outboxMailer)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	messages, err := outbox.Messages(100)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	dat, err := json.Marshal(messages)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
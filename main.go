@@ -3,19 +3,36 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
 
 	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/password"
+	"github.com/daniilgaltsev/chirpylike/internal/pubsub"
 )
 
 type apiConfig struct {
 	hits int
 	jwtSecret string
 	polkaApiKey string
+	polkaWebhookSecret string
+	adminApiKey string
+	mailer Mailer
+	requireVerifiedEmail bool
+	chirpEditWindow time.Duration
+	entitlements entitlementTiers
+	chirpLimiter *chirpRateLimiter
+	chirpEvents *pubsub.Bus[streamEvent]
+	notifications *pubsub.Bus[notificationEvent]
+	loginGuard *loginGuard
+	hasher *password.Hasher
+	passwordPolicy *password.Policy
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -48,20 +65,52 @@ func (cfg *apiConfig) resetHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-func (cfg *apiConfig) handleChirpsPost(w http.ResponseWriter, r *http.Request) {
-	handleChirpsPost(w, r, cfg.jwtSecret)
+func (cfg *apiConfig) handleChirpsDeleteId(w http.ResponseWriter, r *http.Request) {
+	handleChirpsDeleteId(w, r, cfg.chirpEvents)
 }
 
-func (cfg *apiConfig) handleChirpsDeleteId(w http.ResponseWriter, r *http.Request) {
-	handleChirpsDeleteId(w, r, cfg.jwtSecret)
+func (cfg *apiConfig) handleChirpsLikesPut(w http.ResponseWriter, r *http.Request) {
+	handleChirpsLikesPut(w, r, cfg.notifications)
 }
 
-func (cfg *apiConfig) handleLoginPost(w http.ResponseWriter, r *http.Request) {
-	handleLoginPost(w, r, cfg.jwtSecret)
+func (cfg *apiConfig) handleUsersFollowPut(w http.ResponseWriter, r *http.Request) {
+	handleUsersFollowPut(w, r, cfg.notifications)
+}
+
+func (cfg *apiConfig) handleChirpsStreamGet(w http.ResponseWriter, r *http.Request) {
+	handleChirpsStreamGet(w, r, cfg.chirpEvents)
+}
+
+func (cfg *apiConfig) handleChirpsPatch(w http.ResponseWriter, r *http.Request) {
+	handleChirpsPatch(w, r, cfg.chirpEditWindow, cfg.entitlements)
+}
+
+func (cfg *apiConfig) handleMeEntitlementsGet(w http.ResponseWriter, r *http.Request) {
+	handleMeEntitlementsGet(w, r, cfg.entitlements)
+}
+
+func (cfg *apiConfig) handleUsersPost(w http.ResponseWriter, r *http.Request) {
+	handleUsersPost(w, r, cfg.mailer, cfg.hasher, cfg.passwordPolicy)
 }
 
 func (cfg *apiConfig) handleUsersPut(w http.ResponseWriter, r *http.Request) {
-	handleUsersPut(w, r, cfg.jwtSecret)
+	handleUsersPut(w, r, cfg.mailer, cfg.hasher, cfg.passwordPolicy)
+}
+
+func (cfg *apiConfig) handleUsersDelete(w http.ResponseWriter, r *http.Request) {
+	handleUsersDelete(w, r, cfg.loginGuard, cfg.hasher, cfg.chirpEvents)
+}
+
+func (cfg *apiConfig) handleUsersVerifyResendPost(w http.ResponseWriter, r *http.Request) {
+	handleUsersVerifyResendPost(w, r, cfg.mailer)
+}
+
+func (cfg *apiConfig) handleLoginPost(w http.ResponseWriter, r *http.Request) {
+	handleLoginPost(w, r, cfg.jwtSecret, cfg.loginGuard, cfg.hasher)
+}
+
+func (cfg *apiConfig) handleLoginMfaPost(w http.ResponseWriter, r *http.Request) {
+	handleLoginMfaPost(w, r, cfg.jwtSecret, cfg.loginGuard)
 }
 
 func (cfg *apiConfig) handleRefreshPost(w http.ResponseWriter, r *http.Request) {
@@ -72,15 +121,27 @@ func (cfg *apiConfig) handleRevokePost(w http.ResponseWriter, r *http.Request) {
 	handleRevokePost(w, r, cfg.jwtSecret)
 }
 
+func (cfg *apiConfig) handlePasswordForgotPost(w http.ResponseWriter, r *http.Request) {
+	handlePasswordForgotPost(w, r, cfg.mailer)
+}
+
+func (cfg *apiConfig) handlePasswordResetPost(w http.ResponseWriter, r *http.Request) {
+	handlePasswordResetPost(w, r, cfg.hasher, cfg.passwordPolicy)
+}
+
+func (cfg *apiConfig) handleAdminUsersUnlockPost(w http.ResponseWriter, r *http.Request) {
+	handleAdminUsersUnlockPost(w, r, cfg.loginGuard)
+}
+
 func (cfg *apiConfig) handlePolkaWebhooksPost(w http.ResponseWriter, r *http.Request) {
-	handlePolkaWebhooksPost(w, r, cfg.polkaApiKey)
+	handlePolkaWebhooksPost(w, r, cfg.polkaApiKey, cfg.polkaWebhookSecret)
 }
 
 
 func middlewareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -97,6 +158,44 @@ func healthHanlder(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// passwordParamsFromEnv reads the PASSWORD_* settings, anything not set
+// keeps its default.
+func passwordParamsFromEnv() (password.Params, int, error) {
+	params := password.DefaultParams()
+	minLength := 8
+
+	if algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm != "" {
+		params.Algorithm = password.Algorithm(algorithm)
+	}
+
+	ints := []struct {
+		name string
+		set func(int)
+	}{
+		{"PASSWORD_BCRYPT_COST", func(v int) { params.BcryptCost = v }},
+		{"PASSWORD_ARGON2_MEMORY_KIB", func(v int) { params.Argon2Memory = uint32(v) }},
+		{"PASSWORD_ARGON2_ITERATIONS", func(v int) { params.Argon2Iterations = uint32(v) }},
+		{"PASSWORD_ARGON2_PARALLELISM", func(v int) { params.Argon2Parallelism = uint8(v) }},
+		{"PASSWORD_MIN_LENGTH", func(v int) { minLength = v }},
+	}
+	for _, setting := range ints {
+		raw := os.Getenv(setting.name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil || value <= 0 || value > math.MaxUint32 {
+			return params, 0, fmt.Errorf("%s must be a positive integer", setting.name)
+		}
+		if setting.name == "PASSWORD_ARGON2_PARALLELISM" && value > math.MaxUint8 {
+			return params, 0, fmt.Errorf("%s must be at most %d", setting.name, math.MaxUint8)
+		}
+		setting.set(value)
+	}
+
+	return params, minLength, nil
+}
+
 func main() {
 	fmt.Println("Starting server")
 
@@ -118,6 +217,65 @@ func main() {
 		os.Exit(1)
 	}
 
+	polkaWebhookSecret := os.Getenv("POLKA_WEBHOOK_SECRET")
+	if polkaWebhookSecret == "" {
+		fmt.Println("POLKA_WEBHOOK_SECRET is not set")
+		os.Exit(1)
+	}
+
+	adminApiKey := os.Getenv("ADMIN_API_KEY")
+	if adminApiKey == "" {
+		fmt.Println("ADMIN_API_KEY is not set, protected admin endpoints are disabled")
+	}
+
+	outboxDir := os.Getenv("MAIL_OUTBOX_DIR")
+	if outboxDir == "" {
+		outboxDir = defaultOutboxDir
+	}
+	mailer, err := newOutboxMailer(outboxDir)
+	if err != nil {
+		fmt.Println("Error creating mail outbox:", err)
+		os.Exit(1)
+	}
+
+	// Off by default so existing accounts keep working until they verify
+	requireVerifiedEmail := os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true"
+
+	chirpEditWindow := defaultChirpEditWindow
+	if raw := os.Getenv("CHIRP_EDIT_WINDOW"); raw != "" {
+		chirpEditWindow, err = time.ParseDuration(raw)
+		if err != nil || chirpEditWindow < 0 {
+			fmt.Println("CHIRP_EDIT_WINDOW must be a duration like 30m")
+			os.Exit(1)
+		}
+	}
+
+	entitlements, err := entitlementTiersFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	passwordParams, passwordMinLength, err := passwordParamsFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	hasher, err := password.NewHasher(passwordParams)
+	if err != nil {
+		fmt.Println("Error configuring password hashing:", err)
+		os.Exit(1)
+	}
+	passwordPolicy, err := password.NewPolicy(
+		passwordMinLength,
+		hasher.MaxPasswordBytes(),
+		os.Getenv("PASSWORD_BREACHED_LIST"),
+	)
+	if err != nil {
+		fmt.Println("Error loading password policy:", err)
+		os.Exit(1)
+	}
+
 	dbg := flag.Bool("debug", false, "Enable debug mode")
 	flag.Parse()
 	
@@ -133,6 +291,18 @@ func main() {
 	config := apiConfig{
 		jwtSecret: jwtSecret,
 		polkaApiKey: polkaApiKey,
+		polkaWebhookSecret: polkaWebhookSecret,
+		adminApiKey: adminApiKey,
+		mailer: mailer,
+		requireVerifiedEmail: requireVerifiedEmail,
+		chirpEditWindow: chirpEditWindow,
+		entitlements: entitlements,
+		chirpLimiter: newChirpRateLimiter(),
+		chirpEvents: newChirpEvents(),
+		notifications: newNotifications(),
+		loginGuard: newLoginGuard(),
+		hasher: hasher,
+		passwordPolicy: passwordPolicy,
 	}
 
 	router := chi.NewRouter()
@@ -146,13 +316,49 @@ func main() {
 	apiRouter := chi.NewRouter()
 	apiRouter.Get("/healthz", healthHanlder)
 	apiRouter.HandleFunc("/reset", config.resetHandler)
-	apiRouter.Post("/chirps", config.handleChirpsPost)
-	apiRouter.Get("/chirps", handleChirpsGet)
-	apiRouter.Get("/chirps/{id}", handleChirpsGetId)
-	apiRouter.Delete("/chirps/{id}", config.handleChirpsDeleteId)
-	apiRouter.Post("/users", handleUsersPost)
-	apiRouter.Put("/users", config.handleUsersPut)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeChirpsWrite)).Post("/chirps", config.handleChirpsPost)
+	apiRouter.With(config.middlewareOptionalAuth, requireScope(scopeChirpsRead)).Get("/chirps", handleChirpsGet)
+	apiRouter.With(config.middlewareOptionalAuth, requireScope(scopeChirpsRead)).Get("/chirps/search", handleChirpsSearchGet)
+	apiRouter.Get("/stream/chirps", config.handleChirpsStreamGet)
+	apiRouter.With(config.middlewareOptionalAuth).Get("/ws", config.handleWs)
+	apiRouter.With(config.middlewareOptionalAuth, requireScope(scopeChirpsRead)).Get("/chirps/{id}", handleChirpsGetId)
+	apiRouter.With(config.middlewareOptionalAuth, requireScope(scopeChirpsRead)).Get("/chirps/{id}/thread", handleChirpsThreadGet)
+	apiRouter.With(config.middlewareOptionalAuth, requireScope(scopeChirpsRead)).Get("/chirps/{id}/revisions", handleChirpsRevisionsGet)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeChirpsWrite)).Patch("/chirps/{id}", config.handleChirpsPatch)
+	apiRouter.With(config.middlewareOptionalAuth, requireScope(scopeChirpsRead)).Get("/chirps/{id}/likes", handleChirpsLikesGet)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeChirpsWrite)).Put("/chirps/{id}/likes", config.handleChirpsLikesPut)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeChirpsWrite)).Delete("/chirps/{id}/likes", handleChirpsLikesDelete)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeChirpsWrite)).Delete("/chirps/{id}", config.handleChirpsDeleteId)
+	apiRouter.Post("/users", config.handleUsersPost)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeProfileWrite)).Put("/users", config.handleUsersPut)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Delete("/users", config.handleUsersDelete)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Get("/users/export", handleUsersExportGet)
+	apiRouter.Get("/users/{user}", handleUsersGetRef)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeProfileWrite)).Put("/users/{user}/follow", config.handleUsersFollowPut)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeProfileWrite)).Delete("/users/{user}/follow", handleUsersFollowDelete)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeProfileWrite)).Put("/users/{user}/block", handleUsersBlockPut)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeProfileWrite)).Delete("/users/{user}/block", handleUsersBlockDelete)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeProfileWrite)).Put("/users/{user}/mute", handleUsersMutePut)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeProfileWrite)).Delete("/users/{user}/mute", handleUsersMuteDelete)
+	apiRouter.With(config.middlewareRequireAuth).Get("/me/entitlements", config.handleMeEntitlementsGet)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Get("/blocks", handleBlocksGet)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Get("/mutes", handleMutesGet)
+	apiRouter.Get("/users/{user}/followers", handleUsersFollowersGet)
+	apiRouter.Get("/users/{user}/following", handleUsersFollowingGet)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeChirpsRead)).Get("/timeline", handleTimelineGet)
+	apiRouter.Post("/users/verify", handleUsersVerifyPost)
+	apiRouter.With(config.middlewareRequireAuth, requireScope(scopeProfileWrite)).Post("/users/verify/resend", config.handleUsersVerifyResendPost)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Post("/tokens", handleTokensPost)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Get("/tokens", handleTokensGet)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Delete("/tokens/{id}", handleTokensDeleteId)
 	apiRouter.Post("/login", config.handleLoginPost)
+	apiRouter.Post("/login/mfa", config.handleLoginMfaPost)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Post("/mfa/totp", handleMfaTotpPost)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Post("/mfa/totp/confirm", handleMfaTotpConfirmPost)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Delete("/mfa/totp", handleMfaTotpDelete)
+	apiRouter.With(config.middlewareRequireAuth, requireSession).Post("/mfa/recovery-codes", handleMfaRecoveryCodesPost)
+	apiRouter.Post("/password/forgot", config.handlePasswordForgotPost)
+	apiRouter.Post("/password/reset", config.handlePasswordResetPost)
 	apiRouter.Post("/refresh", config.handleRefreshPost)
 	apiRouter.Post("/revoke", config.handleRevokePost)
 	apiRouter.Post("/polka/webhooks", config.handlePolkaWebhooksPost)
@@ -160,10 +366,26 @@ func main() {
 
 	adminRouter := chi.NewRouter()
 	adminRouter.Get("/metrics", config.metricsHandler)
+	adminRouter.With(config.middlewareAdminAuth).Get("/outbox", config.handleOutboxGet)
+	adminRouter.With(config.middlewareAdminAuth).Post("/users/{id}/unlock", config.handleAdminUsersUnlockPost)
+	adminRouter.With(config.middlewareAdminAuth).Get("/webhooks", handleAdminWebhooksGet)
+	adminRouter.With(config.middlewareAdminAuth).Get("/webhooks/{id}", handleAdminWebhooksGetId)
+	adminRouter.With(config.middlewareAdminAuth).Post("/webhooks/{id}/replay", handleAdminWebhooksReplayPost)
+	adminRouter.With(config.middlewareAdminAuth).Post("/webhook-endpoints", handleAdminWebhookEndpointsPost)
+	adminRouter.With(config.middlewareAdminAuth).Get("/webhook-endpoints", handleAdminWebhookEndpointsGet)
+	adminRouter.With(config.middlewareAdminAuth).Get("/webhook-endpoints/{id}", handleAdminWebhookEndpointsGetId)
+	adminRouter.With(config.middlewareAdminAuth).Patch("/webhook-endpoints/{id}", handleAdminWebhookEndpointsPatch)
+	adminRouter.With(config.middlewareAdminAuth).Delete("/webhook-endpoints/{id}", handleAdminWebhookEndpointsDelete)
+	adminRouter.With(config.middlewareAdminAuth).Get("/webhook-deliveries", handleAdminWebhookDeliveriesGet)
+	adminRouter.With(config.middlewareAdminAuth).Get("/webhook-deliveries/{id}", handleAdminWebhookDeliveriesGetId)
+	adminRouter.With(config.middlewareAdminAuth).Post("/webhook-deliveries/{id}/retry", handleAdminWebhookDeliveriesRetryPost)
 	router.Mount("/admin", adminRouter)
 
 	corsRouter := middlewareCors(router)
 
+	go runMembershipExpiry(membershipExpiryInterval)
+	go runWebhookDispatcher(&http.Client{Timeout: webhookDeliveryTimeout}, webhookDispatchInterval)
+
 	server := http.Server{
 		Addr: "0.0.0.0:8080",
 		Handler: corsRouter,
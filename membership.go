@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+const membershipExpiryInterval = time.Minute
+
+// runMembershipExpiry ends memberships whose paid period is over without
+// a renewal, checking every interval for as long as the server runs.
+func runMembershipExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		expired, err := database.ExpireMemberships(time.Now())
+		if err != nil {
+			fmt.Println("Error expiring memberships:", err)
+		} else if len(expired) > 0 {
+			fmt.Println("Expired memberships:", len(expired))
+		}
+
+		for _, membership := range expired {
+			emitWebhookEvent(webhookEventMembershipChanged, newWebhookMembership(membership))
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+const mfaChallengeLifetime = 5 * time.Minute
+const recoveryCodeCount = 10
+
+var errSecondFactorInvalid = errors.New("invalid second factor")
+
+type requestSecondFactor struct {
+	Code string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+
+// generateRecoveryCodes returns the codes to show the user once and the
+// hashes to store in their place.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := randomToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := raw[:5] + "-" + raw[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code, and marks whichever was used so it can't be used again.
+func verifySecondFactor(user database.User, factor requestSecondFactor) error {
+	if factor.Code != "" {
+		step, ok := validateTotp(user.TotpSecret, factor.Code, time.Now(), user.TotpLastStep)
+		if !ok {
+			return errSecondFactorInvalid
+		}
+		_, err := database.UseTotpStep(user.Id, step)
+		if errors.Is(err, database.ErrTotpStepUsed) {
+			return errSecondFactorInvalid
+		}
+		return err
+	}
+
+	if factor.RecoveryCode != "" {
+		hash := hashToken(normalizeRecoveryCode(factor.RecoveryCode))
+		_, err := database.UseRecoveryCode(user.Id, hash)
+		if errors.Is(err, database.ErrRecoveryCodeInvalid) {
+			return errSecondFactorInvalid
+		}
+		return err
+	}
+
+	return errSecondFactorInvalid
+}
+
+func respondWithRecoveryCodes(w http.ResponseWriter, codes []string) {
+	type responseRecoveryCodes struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	dat, err := json.Marshal(responseRecoveryCodes{RecoveryCodes: codes})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+func respondWithMfaChallenge(w http.ResponseWriter, user database.User, jwtSecret string) {
+	type responseChallenge struct {
+		MfaRequired bool `json:"mfa_required"`
+		MfaToken string `json:"mfa_token"`
+	}
+
+	token, err := signJWT(user.Id, jwtSecret, issuerMfa, mfaChallengeLifetime)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	dat, err := json.Marshal(responseChallenge{MfaRequired: true, MfaToken: token})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+
+func handleMfaTotpPost(w http.ResponseWriter, r *http.Request) {
+	type responseEnrollment struct {
+		Secret string `json:"secret"`
+		OtpauthUri string `json:"otpauth_uri"`
+	}
+
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if p.User.TotpEnabled {
+		respondWithJsonError(w, "TOTP is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTotpSecret()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = database.SetPendingTotpSecret(p.User.Id, secret)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := responseEnrollment{
+		Secret: secret,
+		OtpauthUri: totpUri(secret, p.User.Email),
+	}
+
+	dat, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+func handleMfaTotpConfirmPost(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body requestSecondFactor
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil || body.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if p.User.TotpPendingSecret == "" {
+		chirpsRespondWithJsonError(w, "TOTP enrollment was not started")
+		return
+	}
+
+	step, ok := validateTotp(p.User.TotpPendingSecret, body.Code, time.Now(), 0)
+	if !ok {
+		chirpsRespondWithJsonError(w, "Invalid TOTP code")
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = database.EnableTotp(p.User.Id, step, hashes)
+	if errors.Is(err, database.ErrTotpNotPending) {
+		chirpsRespondWithJsonError(w, "TOTP enrollment was not started")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithRecoveryCodes(w, codes)
+}
+
+func handleMfaTotpDelete(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !p.User.TotpEnabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var body requestSecondFactor
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = verifySecondFactor(p.User, body)
+	if errors.Is(err, errSecondFactorInvalid) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = database.DisableTotp(p.User.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMfaRecoveryCodesPost replaces all recovery codes with new ones
+func handleMfaRecoveryCodesPost(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !p.User.TotpEnabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var body requestSecondFactor
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil || body.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = verifySecondFactor(p.User, requestSecondFactor{Code: body.Code})
+	if errors.Is(err, errSecondFactorInvalid) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = database.SetRecoveryCodes(p.User.Id, hashes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithRecoveryCodes(w, codes)
+}
+
+// handleLoginMfaPost is the second step of logging in to an account with
+// TOTP enabled, it exchanges the challenge token and a code for tokens.
+func handleLoginMfaPost(w http.ResponseWriter, r *http.Request, jwtSecret string, guard *loginGuard) {
+	type requestLoginMfa struct {
+		MfaToken string `json:"mfa_token"`
+		requestSecondFactor
+	}
+
+	var body requestLoginMfa
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil || body.MfaToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	claims, err := parseJWT(body.MfaToken, jwtSecret)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	issuer, err := claims.GetIssuer()
+	if err != nil || issuer != issuerMfa {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	subject, err := claims.GetSubject()
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(subject)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := database.GetUser(id)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !user.TotpEnabled {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Codes are short, so wrong ones count towards the same lockout as passwords
+	ip := clientIp(r)
+	wait := guard.lockedFor(user.Email, ip)
+	if wait > 0 {
+		respondWithLoginLocked(w, wait)
+		return
+	}
+
+	err = verifySecondFactor(user, body.requestSecondFactor)
+	if errors.Is(err, errSecondFactorInvalid) {
+		guard.fail(user.Email, ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	guard.succeed(user.Email)
+
+	respondWithLoginTokens(w, r, user, jwtSecret)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/pubsub"
+)
+
+const notificationReply = "reply"
+const notificationRechirp = "rechirp"
+const notificationQuote = "quote"
+const notificationLike = "like"
+const notificationFollow = "follow"
+
+// Notifications are only delivered live, the buffer is just what a bus
+// needs to exist
+const notificationBufferSize = 100
+const notificationQueueSize = 64
+
+// notificationEvent is a notification for one user
+type notificationEvent struct {
+	RecipientId int
+	// Data is the notification as sent to clients
+	Data json.RawMessage
+}
+
+type notification struct {
+	Kind string `json:"kind"`
+	Actor authorSummary `json:"actor"`
+	// ChirpId is the recipient's chirp that was replied to, rechirped,
+	// quoted or liked
+	ChirpId int `json:"chirp_id,omitempty"`
+	// ByChirpId is the reply, rechirp or quote
+	ByChirpId int `json:"by_chirp_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newNotifications() *pubsub.Bus[notificationEvent] {
+	return pubsub.New[notificationEvent](notificationBufferSize, notificationQueueSize)
+}
+
+// notify sends a notification about actorId to recipientId, unless they are
+// the same user or the recipient blocked or muted the actor
+func notify(notifications *pubsub.Bus[notificationEvent], db database.Database, recipientId, actorId int, n notification) {
+	if recipientId == actorId || db.IsBlocked(recipientId, actorId) || db.IsMuted(recipientId, actorId) {
+		return
+	}
+	actor, ok := db.Users[actorId]
+	if !ok {
+		return
+	}
+
+	n.Actor = newAuthorSummary(actor)
+	n.CreatedAt = time.Now().UTC()
+	dat, err := json.Marshal(n)
+	if err != nil {
+		fmt.Println("Error publishing notification:", err)
+		return
+	}
+	notifications.Publish(notificationEvent{
+		RecipientId: recipientId,
+		Data: dat,
+	})
+}
+
+// notifyChirpCreated notifies the authors of the chirps a new chirp replies
+// to, rechirps or quotes
+func notifyChirpCreated(notifications *pubsub.Bus[notificationEvent], db database.Database, chirp database.Chirp) {
+	targets := []struct {
+		kind string
+		chirpId int
+	}{
+		{notificationReply, chirp.InReplyToId},
+		{notificationRechirp, chirp.RechirpOfId},
+		{notificationQuote, chirp.QuoteOfId},
+	}
+	for _, target := range targets {
+		if target.chirpId == 0 {
+			continue
+		}
+		notify(notifications, db, db.Chirps[target.chirpId].AuthorId, chirp.AuthorId, notification{
+			Kind: target.kind,
+			ChirpId: target.chirpId,
+			ByChirpId: chirp.Id,
+		})
+	}
+}
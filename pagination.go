@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultPageLimit = 20
+const maxPageLimit = 100
+
+// pageCursor is the position after the last item of a page. It is handed
+// to clients base64 encoded and they should treat it as opaque.
+type pageCursor struct {
+	// Order is the sort order the cursor was made for
+	Order string `json:"o"`
+	// Key and Id are the sort key and id of the last item
+	Key int64 `json:"k,omitempty"`
+	Id int `json:"i,omitempty"`
+	// Offset is the number of items already returned, used instead of Key
+	// and Id by orders without a stable key like search relevance
+	Offset int `json:"n,omitempty"`
+}
+
+type pageParams struct {
+	// paginated is false when the request used none of the parameters,
+	// such requests get the full list as before pagination existed
+	paginated bool
+	limit int
+	cursor *pageCursor
+	sinceId int
+	maxId int
+}
+
+func encodeCursor(cursor pageCursor) string {
+	dat, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+func decodeCursor(raw string) (pageCursor, error) {
+	dat, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return pageCursor{}, errors.New("invalid cursor")
+	}
+	var cursor pageCursor
+	err = json.Unmarshal(dat, &cursor)
+	if err != nil || cursor.Offset < 0 {
+		return pageCursor{}, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+func parsePageParams(r *http.Request) (pageParams, error) {
+	query := r.URL.Query()
+	params := pageParams{limit: defaultPageLimit}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return params, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		params.limit = limit
+		params.paginated = true
+	}
+	if raw := query.Get("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil {
+			return params, err
+		}
+		params.cursor = &cursor
+		params.paginated = true
+	}
+	if raw := query.Get("since_id"); raw != "" {
+		sinceId, err := strconv.Atoi(raw)
+		if err != nil {
+			return params, errors.New("since_id must be an integer")
+		}
+		params.sinceId = sinceId
+		params.paginated = true
+	}
+	if raw := query.Get("max_id"); raw != "" {
+		maxId, err := strconv.Atoi(raw)
+		if err != nil {
+			return params, errors.New("max_id must be an integer")
+		}
+		params.maxId = maxId
+		params.paginated = true
+	}
+
+	return params, nil
+}
+
+// setNextLinkHeader adds an RFC 8288 Link to the next page, which is the
+// current request with the cursor replaced.
+func setNextLinkHeader(w http.ResponseWriter, r *http.Request, nextCursor string) {
+	query := r.URL.Query()
+	query.Set("cursor", nextCursor)
+	next := *r.URL
+	next.RawQuery = query.Encode()
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+}
+
+// newestFirstAfter reports whether an item created at t with id comes after
+// the one at key and keyId in a newest first listing, ties going to the
+// higher id first.
+func newestFirstAfter(t time.Time, id int, key int64, keyId int) bool {
+	if t.UnixNano() != key {
+		return t.UnixNano() < key
+	}
+	return id < keyId
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/password"
+)
+
+const passwordResetTokenLifetime = 30 * time.Minute
+
+
+func handlePasswordForgotPost(w http.ResponseWriter, r *http.Request, mailer Mailer) {
+	type requestForgot struct {
+		Email string `json:"email"`
+	}
+
+	var body requestForgot
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil || body.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The response is the same whether or not the account exists,
+	// so this endpoint can't be used to look up registered emails
+	user, err := database.GetUserByEmail(body.Email)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	err = database.SaveOneTimeToken(database.OneTimeToken{
+		Hash: hashToken(token),
+		Purpose: database.TokenPurposePasswordReset,
+		UserId: user.Id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTokenLifetime),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = mailer.Send(mailMessage{
+		To: user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password of your Chirpy account.\n\n"+
+			"Use this token with POST /api/password/reset within %d minutes:\n\n%s\n\n"+
+			"If it wasn't you, you can ignore this message.\n",
+			int(passwordResetTokenLifetime.Minutes()),
+			token,
+		),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handlePasswordResetPost(w http.ResponseWriter, r *http.Request, hasher *password.Hasher, policy *password.Policy) {
+	type requestReset struct {
+		Token string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	var body requestReset
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil || body.Token == "" || body.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Checked before the token is consumed, so a rejected password
+	// doesn't cost the user their token
+	err = policy.Validate(body.Password)
+	if err != nil {
+		respondWithPasswordError(w, err)
+		return
+	}
+
+	token, err := database.ConsumeOneTimeToken(hashToken(body.Token), database.TokenPurposePasswordReset)
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenExpired) || errors.Is(err, database.ErrTokenUsed) {
+		chirpsRespondWithJsonError(w, "Reset token is invalid or has expired")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	passwordHash, err := hasher.Hash(body.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Whoever may have had access to the account loses it
+	_, err = database.ResetUserPassword(token.UserId, passwordHash)
+	if errors.Is(err, database.ErrUserNotFound) {
+		chirpsRespondWithJsonError(w, "Reset token is invalid or has expired")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+const personalAccessTokenPrefix = "chirpy_pat_"
+
+const scopeChirpsRead = "chirps:read"
+const scopeChirpsWrite = "chirps:write"
+const scopeProfileWrite = "profile:write"
+
+var knownScopes = []string{scopeChirpsRead, scopeChirpsWrite, scopeProfileWrite}
+
+
+type responsePersonalAccessToken struct {
+	Id int `json:"id"`
+	Name string `json:"name"`
+	Scopes []string `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+func newResponsePersonalAccessToken(token database.PersonalAccessToken) responsePersonalAccessToken {
+	return responsePersonalAccessToken{
+		Id: token.Id,
+		Name: token.Name,
+		Scopes: token.Scopes,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	}
+}
+
+func isPersonalAccessToken(authorization string) bool {
+	return strings.HasPrefix(authorization, "Bearer "+personalAccessTokenPrefix)
+}
+
+func generatePersonalAccessToken() (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	return personalAccessTokenPrefix + token, nil
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, knownScope := range knownScopes {
+			if scope == knownScope {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errors.New("unknown scope: " + scope)
+		}
+	}
+	return nil
+}
+
+
+func handleTokensPost(w http.ResponseWriter, r *http.Request) {
+	type requestToken struct {
+		Name string `json:"name"`
+		Scopes []string `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body requestToken
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil {
+		chirpsRespondWithJsonError(w, "Something went wrong")
+		return
+	}
+
+	if strings.TrimSpace(body.Name) == "" {
+		chirpsRespondWithJsonError(w, "Token name is required")
+		return
+	}
+	err = validateScopes(body.Scopes)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		chirpsRespondWithJsonError(w, "Token expiry must be in the future")
+		return
+	}
+
+	tokenString, err := generatePersonalAccessToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	token, err := database.SavePersonalAccessToken(
+		p.User.Id,
+		body.Name,
+		hashToken(tokenString),
+		body.Scopes,
+		body.ExpiresAt,
+	)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The token itself is only ever shown in this response
+	response := newResponsePersonalAccessToken(token)
+	response.Token = tokenString
+
+	dat, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusCreated)
+}
+
+func handleTokensGet(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := database.ListPersonalAccessTokens(p.User.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]responsePersonalAccessToken, 0, len(tokens))
+	for _, token := range tokens {
+		response = append(response, newResponsePersonalAccessToken(token))
+	}
+
+	dat, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+func handleTokensDeleteId(w http.ResponseWriter, r *http.Request) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = database.DeletePersonalAccessToken(p.User.Id, id)
+	if errors.Is(err, database.ErrTokenNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,64 +1,261 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/daniilgaltsev/chirpylike/internal/database"
 )
 
+const polkaSignatureHeader = "X-Polka-Signature"
+const polkaTimestampHeader = "X-Polka-Timestamp"
+const webhookSignaturePrefix = "sha256="
+
+// polkaSignatureTolerance is how far the signed timestamp may be from now,
+// older requests are rejected as replays
+const polkaSignatureTolerance = 5 * time.Minute
+
+const maxPolkaBodyBytes = 1 << 20
+
+// Anyone can send requests that fail verification, so only this much of
+// them is kept in the event log
+const maxUnverifiedBodyBytes = 1 << 10
+const maxUnverifiedHeaders = 32
+const maxUnverifiedHeaderBytes = 256
+
+var errPolkaSignatureMissing = errors.New("signature headers missing")
+var errPolkaSignatureExpired = errors.New("signature timestamp outside the tolerance window")
+var errPolkaSignatureInvalid = errors.New("signature does not match")
+
 func parseAuthorizationPolkaApiKey(authorization, polkaApiKey string) bool {
-	if authorization == "" {
+	apiKey, found := strings.CutPrefix(authorization, "ApiKey ")
+	if !found {
 		return false
 	}
+	return subtle.ConstantTimeCompare([]byte(apiKey), []byte(polkaApiKey)) == 1
+}
 
-	apiKeyLength := len("ApiKey ")
-	if len(authorization) < apiKeyLength {
-		return false
+// webhookSignature is the hex HMAC-SHA256 of the timestamp and body joined
+// by a dot, the timestamp being unix seconds. Outgoing webhooks are signed
+// the same way.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyPolkaSignature checks the signature headers of a webhook request
+func verifyPolkaSignature(header http.Header, body []byte, secret string, now time.Time) error {
+	timestamp := header.Get(polkaTimestampHeader)
+	signature, found := strings.CutPrefix(header.Get(polkaSignatureHeader), webhookSignaturePrefix)
+	if timestamp == "" || !found {
+		return errPolkaSignatureMissing
 	}
-	apiKey := authorization[apiKeyLength:]
-	
-	if apiKey != polkaApiKey {
-		return false
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errPolkaSignatureInvalid
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > polkaSignatureTolerance || skew < -polkaSignatureTolerance {
+		return errPolkaSignatureExpired
+	}
+
+	expected := webhookSignature(secret, timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errPolkaSignatureInvalid
 	}
+	return nil
+}
 
-	return true
+// membershipPeriod is the paid period assumed when an event doesn't say
+// when it ends
+const membershipPeriod = 30 * 24 * time.Hour
+
+// polkaMembershipEvents are the events that change memberships, others
+// are acknowledged and ignored
+var polkaMembershipEvents = map[string]bool{
+	database.MembershipEventUpgraded: true,
+	database.MembershipEventDowngraded: true,
+	database.MembershipEventRenewed: true,
+	database.MembershipEventCancelled: true,
+	database.MembershipEventRefunded: true,
 }
 
+type polkaEvent struct {
+	// Id identifies the event, redeliveries have the same id
+	Id string `json:"id"`
+	Event string `json:"event"`
+	Data struct {
+		UserId int `json:"user_id"`
+		// ExpiresAt is the end of the paid period, sent with
+		// upgrades and renewals
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+}
 
-func handlePolkaWebhooksPost(w http.ResponseWriter, r *http.Request, polkaApiKey string) {
-	type requestBody struct {
-		Event string `json:"event"`
-		Data struct {
-			UserId int `json:"user_id"`
-		}
+var errPolkaApiKeyInvalid = errors.New("API key missing or invalid")
+var errPolkaEventIdMissing = errors.New("event id missing")
+
+// verifyPolkaRequest checks the API key and the body signature, see
+// verifyPolkaSignature.
+func verifyPolkaRequest(header http.Header, body []byte, polkaApiKey, webhookSecret string, now time.Time) error {
+	if !parseAuthorizationPolkaApiKey(header.Get("Authorization"), polkaApiKey) {
+		return errPolkaApiKeyInvalid
 	}
+	return verifyPolkaSignature(header, body, webhookSecret, now)
+}
 
-	isValid := parseAuthorizationPolkaApiKey(r.Header.Get("Authorization"), polkaApiKey)
-	if !isValid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+// webhookHeaders are the headers of a webhook request as they are stored,
+// without the credentials
+func webhookHeaders(header http.Header) map[string]string {
+	headers := map[string]string{}
+	for name, values := range header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	if authorization, ok := headers["Authorization"]; ok {
+		scheme, _, _ := strings.Cut(authorization, " ")
+		headers["Authorization"] = scheme + " [redacted]"
+	}
+	return headers
+}
+
+// truncateUnverifiedWebhook cuts down what is stored of a request that
+// failed verification
+func truncateUnverifiedWebhook(event *database.WebhookEvent, raw []byte) {
+	if len(raw) > maxUnverifiedBodyBytes {
+		sum := sha256.Sum256(raw)
+		event.Body = string(raw[:maxUnverifiedBodyBytes])
+		event.BodyTruncated = true
+		event.BodySha256 = hex.EncodeToString(sum[:])
+	}
+
+	names := make([]string, 0, len(event.Headers))
+	for name := range event.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := map[string]string{}
+	for _, name := range names[:min(len(names), maxUnverifiedHeaders)] {
+		value := event.Headers[name]
+		headers[name] = value[:min(len(value), maxUnverifiedHeaderBytes)]
+	}
+	event.Headers = headers
+}
+
+// processPolkaEvent applies a verified Polka event and returns the outcome
+// along with the status to answer Polka with.
+func processPolkaEvent(raw []byte) (string, int, error) {
+	var body polkaEvent
+	err := json.Unmarshal(raw, &body)
+	if err != nil {
+		return database.WebhookOutcomeInvalid, http.StatusBadRequest, err
+	}
+	// Without an id a redelivery couldn't be told apart from a new event
+	if body.Id == "" {
+		return database.WebhookOutcomeInvalid, http.StatusBadRequest, errPolkaEventIdMissing
+	}
+
+	if !polkaMembershipEvents[body.Event] {
+		return database.WebhookOutcomeIgnored, http.StatusOK, nil
+	}
+
+	paidUntil := time.Now().Add(membershipPeriod)
+	if body.Data.ExpiresAt != nil {
+		paidUntil = *body.Data.ExpiresAt
+	}
+
+	membership, err := database.ApplyMembershipEvent(body.Id, body.Data.UserId, body.Event, paidUntil)
+	if errors.Is(err, database.ErrDuplicateEvent) {
+		// Acknowledged so Polka stops redelivering it
+		return database.WebhookOutcomeDuplicate, http.StatusOK, nil
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		return database.WebhookOutcomeUserNotFound, http.StatusNotFound, err
+	}
+	if err != nil {
+		return database.WebhookOutcomeFailed, http.StatusInternalServerError, err
 	}
 
-	var body requestBody
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&body)
+	emitWebhookEvent(webhookEventMembershipChanged, newWebhookMembership(membership))
+
+	return database.WebhookOutcomeProcessed, http.StatusOK, nil
+}
+
+// handlePolkaWebhooksPost applies membership events from Polka. Every
+// request is stored in the webhook event log first, along with whether it
+// passed verification and what came of processing it. Of unverified
+// requests only a bounded part is stored.
+func handlePolkaWebhooksPost(w http.ResponseWriter, r *http.Request, polkaApiKey, webhookSecret string) {
+	now := time.Now()
+	raw, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPolkaBodyBytes))
+
+	event := database.WebhookEvent{
+		Source: database.WebhookSourcePolka,
+		Headers: webhookHeaders(r.Header),
+		Body: string(raw),
+		ReceivedAt: now,
+	}
+	var body polkaEvent
+	if json.Unmarshal(raw, &body) == nil {
+		event.EventId = body.Id
+		event.EventType = body.Event
+		event.UserId = body.Data.UserId
+	}
+	verifyErr := verifyPolkaRequest(r.Header, raw, polkaApiKey, webhookSecret, now)
+	event.Verified = verifyErr == nil
+	if verifyErr != nil {
+		event.VerificationError = verifyErr.Error()
+		truncateUnverifiedWebhook(&event, raw)
+	}
 
+	event, err := database.SaveWebhookEvent(event)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if body.Event != "user.upgraded" {
-		w.WriteHeader(http.StatusOK)
-		return
+	attempt := database.WebhookAttempt{At: now}
+	status := http.StatusOK
+	switch {
+	case readErr != nil:
+		attempt.Outcome = database.WebhookOutcomeInvalid
+		attempt.Error = readErr.Error()
+		status = http.StatusBadRequest
+	case verifyErr != nil:
+		attempt.Outcome = database.WebhookOutcomeRejected
+		attempt.Error = verifyErr.Error()
+		status = http.StatusUnauthorized
+	default:
+		var processErr error
+		attempt.Outcome, status, processErr = processPolkaEvent(raw)
+		if processErr != nil {
+			attempt.Error = processErr.Error()
+		}
+		attempt.At = time.Now()
 	}
 
-	err = database.UpdateUserMembership(body.Data.UserId)
+	_, err = database.RecordWebhookAttempt(event.Id, attempt)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	if status == http.StatusUnauthorized {
+		respondWithJsonError(w, verifyErr.Error(), status)
+		return
+	}
+	w.WriteHeader(status)
 }
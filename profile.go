@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+const maxDisplayNameLength = 50
+const maxBioLength = 160
+const maxAvatarUrlLength = 2048
+
+// Handles must contain something besides digits, so /api/users/{user}
+// can tell them apart from ids
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,20}$`)
+var handleDigitsPattern = regexp.MustCompile(`^[0-9]+$`)
+
+type requestProfile struct {
+	Handle *string `json:"handle"`
+	DisplayName *string `json:"display_name"`
+	Bio *string `json:"bio"`
+	AvatarUrl *string `json:"avatar_url"`
+}
+
+// authorSummary is the part of a profile embedded in other responses
+type authorSummary struct {
+	Id int `json:"id"`
+	Handle string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarUrl string `json:"avatar_url,omitempty"`
+}
+
+type responseProfile struct {
+	Id int `json:"id"`
+	Handle string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Bio string `json:"bio,omitempty"`
+	AvatarUrl string `json:"avatar_url,omitempty"`
+	ChirpCount int `json:"chirp_count"`
+	FollowerCount int `json:"follower_count"`
+	FollowingCount int `json:"following_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newAuthorSummary(user database.User) authorSummary {
+	return authorSummary{
+		Id: user.Id,
+		Handle: user.Handle,
+		DisplayName: user.DisplayName,
+		AvatarUrl: user.AvatarUrl,
+	}
+}
+
+// validateProfile returns the normalized update to store, or an error
+// meant for the user.
+func validateProfile(body requestProfile) (database.ProfileUpdate, error) {
+	if body.Handle != nil {
+		handle := strings.TrimPrefix(strings.TrimSpace(*body.Handle), "@")
+		if !handlePattern.MatchString(handle) || handleDigitsPattern.MatchString(handle) {
+			return database.ProfileUpdate{}, errors.New("Handle must be 3 to 20 letters, digits or underscores and not only digits")
+		}
+		body.Handle = &handle
+	}
+	if body.DisplayName != nil {
+		displayName := strings.TrimSpace(*body.DisplayName)
+		if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+			return database.ProfileUpdate{}, errors.New("Display name is too long")
+		}
+		body.DisplayName = &displayName
+	}
+	if body.Bio != nil {
+		bio := strings.TrimSpace(*body.Bio)
+		if utf8.RuneCountInString(bio) > maxBioLength {
+			return database.ProfileUpdate{}, errors.New("Bio is too long")
+		}
+		body.Bio = &bio
+	}
+	if body.AvatarUrl != nil && *body.AvatarUrl != "" {
+		parsed, err := url.Parse(*body.AvatarUrl)
+		validScheme := err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
+		if !validScheme || parsed.Host == "" || len(*body.AvatarUrl) > maxAvatarUrlLength {
+			return database.ProfileUpdate{}, errors.New("Avatar URL must be an http or https URL")
+		}
+	}
+
+	return database.ProfileUpdate{
+		Handle: body.Handle,
+		DisplayName: body.DisplayName,
+		Bio: body.Bio,
+		AvatarUrl: body.AvatarUrl,
+	}, nil
+}
+
+// findUserByRef looks a user up by numeric id or by handle, with or
+// without the leading @.
+func findUserByRef(db database.Database, ref string) (database.User, bool) {
+	id, err := strconv.Atoi(ref)
+	if err == nil {
+		user, ok := db.Users[id]
+		return user, ok
+	}
+
+	handle := strings.TrimPrefix(ref, "@")
+	if handle == "" {
+		return database.User{}, false
+	}
+	for _, user := range db.Users {
+		if user.Handle != "" && strings.EqualFold(user.Handle, handle) {
+			return user, true
+		}
+	}
+	return database.User{}, false
+}
+
+
+func handleUsersGetRef(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user, ok := findUserByRef(db, chi.URLParam(r, "user"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	chirpCount := 0
+	for _, chirp := range db.Chirps {
+		if chirp.AuthorId == user.Id {
+			chirpCount++
+		}
+	}
+
+	response := responseProfile{
+		Id: user.Id,
+		Handle: user.Handle,
+		DisplayName: user.DisplayName,
+		Bio: user.Bio,
+		AvatarUrl: user.AvatarUrl,
+		ChirpCount: chirpCount,
+		FollowerCount: len(db.Followers[user.Id]),
+		FollowingCount: len(db.Follows[user.Id]),
+		CreatedAt: user.CreatedAt,
+	}
+
+	dat, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
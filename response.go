@@ -2,6 +2,7 @@ package main
 
 
 import (
+	"encoding/json"
 	"net/http"
 )
 
@@ -10,4 +11,18 @@ func respondWithJson(w http.ResponseWriter, dat []byte, status int) {
 	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(dat)
+}
+
+func respondWithJsonError(w http.ResponseWriter, e string, status int) {
+	type responseError struct {
+		Error string `json:"error"`
+	}
+
+	dat, err := json.Marshal(responseError{Error: e})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, status)
 }
\ No newline at end of file
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+// handleTimelineGet returns the caller's home timeline, their own chirps
+// and those of the users they follow, newest first. Chirps are fanned out
+// to timelines when posted, so this only reads the caller's list.
+func handleTimelineGet(w http.ResponseWriter, r *http.Request) {
+	type responseTimeline struct {
+		Chirps []responseChirp `json:"chirps"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	view, err := parseChirpView(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	order := chirpOrder{field: chirpSortId, descending: true}
+	if page.cursor != nil && page.cursor.Order != order.String() {
+		chirpsRespondWithJsonError(w, "cursor was made for a different sort")
+		return
+	}
+
+	filter, err := parseChirpFilter(r, page)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	policy := newChirpPolicy(db, view)
+	timeline := db.Timelines[p.User.Id]
+	chirps := make([]database.Chirp, 0, len(timeline))
+	for i := len(timeline) - 1; i >= 0; i-- {
+		chirp, ok := db.Chirps[timeline[i]]
+		if ok && filter.matches(chirp) && policy.inFeed(chirp) {
+			chirps = append(chirps, chirp)
+		}
+	}
+
+	chirps, nextCursor := paginateChirps(chirps, order, page)
+	if nextCursor != "" {
+		setNextLinkHeader(w, r, nextCursor)
+	}
+
+	dat, err := json.Marshal(responseTimeline{
+		Chirps: newResponseChirps(db, chirps, view),
+		NextCursor: nextCursor,
+	})
+	if err != nil {
+		chirpsRespondWithInternalError(w)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,22 +19,43 @@ import (
 
 const issuerAccess = "chirpy-access"
 const issuerRefresh = "chirpy-refresh"
+const accessTokenLifetime = time.Hour
+const refreshTokenLifetime = 60 * 24 * time.Hour
+
+// issuerMfa is for the challenge token handed out after a correct password
+// when the account also needs a second factor
+const issuerMfa = "chirpy-mfa"
+
+
+// randomToken returns a random hex string for tokens that are only stored hashed
+func randomToken(size int) (string, error) {
+	raw := make([]byte, size)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
 
 
 func createJWT(id int, jwtSecret string, isRefresh bool) (string, error) {
-	issuer := issuerAccess
-	expiresInSeconds := 60 * 60
 	if isRefresh {
-		issuer = issuerRefresh
-		expiresInSeconds *= 24 * 60
+		return signJWT(id, jwtSecret, issuerRefresh, refreshTokenLifetime)
 	}
+	return signJWT(id, jwtSecret, issuerAccess, accessTokenLifetime)
+}
+
+func signJWT(id int, jwtSecret, issuer string, lifetime time.Duration) (string, error) {
 	now := time.Now()
 	claims := jwt.RegisteredClaims{
 		Issuer: issuer,
 		IssuedAt: jwt.NewNumericDate(now),
-		ExpiresAt: jwt.NewNumericDate(
-			now.Add(time.Duration(expiresInSeconds) * time.Second),
-		),
+		ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
 		Subject: strconv.Itoa(id),
 	}
 	token := jwt.NewWithClaims(
@@ -46,11 +71,20 @@ func parseAuthorization(authorization, jwtSecret string) (string, jwt.Registered
 		return "", jwt.RegisteredClaims{}, errors.New("missing authorization header")
 	}
 
-	bearerLength := len("Bearer ")
-	if len(authorization) < bearerLength {
+	if !strings.HasPrefix(authorization, "Bearer ") {
 		return "", jwt.RegisteredClaims{}, errors.New("invalid authorization header")
 	}
-	tokenString := authorization[bearerLength:]
+	tokenString := strings.TrimPrefix(authorization, "Bearer ")
+
+	claims, err := parseJWT(tokenString, jwtSecret)
+	if err != nil {
+		return tokenString, jwt.RegisteredClaims{}, err
+	}
+
+	return tokenString, claims, nil
+}
+
+func parseJWT(tokenString, jwtSecret string) (jwt.RegisteredClaims, error) {
 	claims := jwt.RegisteredClaims{}
 
 	token, err := jwt.ParseWithClaims(
@@ -61,10 +95,10 @@ func parseAuthorization(authorization, jwtSecret string) (string, jwt.Registered
 		},
 	)
 	if err != nil || !token.Valid {
-		return tokenString, jwt.RegisteredClaims{}, errors.New("invalid token")
+		return jwt.RegisteredClaims{}, errors.New("invalid token")
 	}
 
-	return tokenString, claims, nil
+	return claims, nil
 }
 
 
@@ -99,6 +133,15 @@ func handleRefreshPost(w http.ResponseWriter, r *http.Request, jwtSecret string)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	revoked, err := database.SessionRevoked(hashToken(tokenString))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
 	subject, err := claims.GetSubject()
 	if err != nil {
@@ -111,6 +154,16 @@ func handleRefreshPost(w http.ResponseWriter, r *http.Request, jwtSecret string)
 		return
 	}
 
+	_, err = database.GetUser(id)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	token, err := createJWT(id, jwtSecret, false)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -143,5 +196,11 @@ func handleRevokePost(w http.ResponseWriter, r *http.Request, jwtSecret string)
 		return
 	}
 
+	err = database.RevokeSession(hashToken(tokenString))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
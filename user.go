@@ -3,12 +3,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
-
-	"golang.org/x/crypto/bcrypt"
+	"time"
 
 	"github.com/daniilgaltsev/chirpylike/internal/database"
+	"github.com/daniilgaltsev/chirpylike/internal/password"
 )
 
 type user struct {
@@ -17,11 +18,31 @@ type user struct {
 }
 
 
-func handleUsersPost(w http.ResponseWriter, r *http.Request) {
+// hashNewPassword checks plain against the password policy and hashes it.
+func hashNewPassword(plain string, hasher *password.Hasher, policy *password.Policy) (string, error) {
+	err := policy.Validate(plain)
+	if err != nil {
+		return "", err
+	}
+	return hasher.Hash(plain)
+}
+
+func respondWithPasswordError(w http.ResponseWriter, err error) {
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		respondWithJsonError(w, policyErr.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+
+func handleUsersPost(w http.ResponseWriter, r *http.Request, mailer Mailer, hasher *password.Hasher, policy *password.Policy) {
 	type responseUser struct {
 		Id int `json:"id"`
 		Email string `json:"email"`
 		IsChirpyRed bool `json:"is_chirpy_red"`
+		IsVerified bool `json:"is_verified"`
 	}
 
 	var u user
@@ -37,16 +58,40 @@ func handleUsersPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := database.SaveUser(u.Email, u.Password)
+	passwordHash, err := hashNewPassword(u.Password, hasher, policy)
+	if err != nil {
+		respondWithPasswordError(w, err)
+		return
+	}
+
+	user, err := database.SaveUser(u.Email, passwordHash)
+	if errors.Is(err, database.ErrEmailTaken) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// The account is usable either way, a lost message can be resent
+	err = sendEmailVerification(mailer, user.Id, user.Email)
+	if err != nil {
+		fmt.Println("Error sending verification email:", err)
+	}
+
+	emitWebhookEvent(webhookEventUserCreated, webhookUser{
+		Id: user.Id,
+		IsChirpyRed: user.IsChirpyRed,
+		IsVerified: user.IsVerified,
+		CreatedAt: user.CreatedAt,
+	})
+
 	response := responseUser{
 		Id: user.Id,
 		Email: user.Email,
 		IsChirpyRed: user.IsChirpyRed,
+		IsVerified: user.IsVerified,
 	}
 
 	dat, err := json.Marshal(response)
@@ -58,50 +103,102 @@ func handleUsersPost(w http.ResponseWriter, r *http.Request) {
 	respondWithJson(w, dat, http.StatusCreated)
 }
 
-func handleUsersPut(w http.ResponseWriter, r *http.Request, jwtSecret string) {
+func handleUsersPut(w http.ResponseWriter, r *http.Request, mailer Mailer, hasher *password.Hasher, policy *password.Policy) {
 	type responseUser struct {
 		Id int `json:"id"`
 		Email string `json:"email"`
+		IsVerified bool `json:"is_verified"`
+		PendingEmail string `json:"pending_email,omitempty"`
+		Handle string `json:"handle,omitempty"`
+		DisplayName string `json:"display_name,omitempty"`
+		Bio string `json:"bio,omitempty"`
+		AvatarUrl string `json:"avatar_url,omitempty"`
+	}
+	type requestUser struct {
+		user
+		requestProfile
 	}
 
-	_, claims, err := parseAuthorization(r.Header.Get("Authorization"), jwtSecret)
-	if err != nil {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	id := p.User.Id
 
-	issuer, err := claims.GetIssuer()
+	var body requestUser
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	u := body.user
 
-	if issuer != issuerAccess {
-		w.WriteHeader(http.StatusUnauthorized)
+	// A leaked token must not be enough to take over the account
+	if (u.Password != "" || u.Email != "") && !p.isSession() {
+		respondWithJsonError(w, "Changing the password or email needs a login session", http.StatusForbidden)
 		return
 	}
 
-	stringId, err := claims.GetSubject()
+	profileUpdate, err := validateProfile(body.requestProfile)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		chirpsRespondWithJsonError(w, err.Error())
 		return
 	}
 
-	id, err := strconv.Atoi(stringId)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	passwordHash := ""
+	if u.Password != "" {
+		passwordHash, err = hashNewPassword(u.Password, hasher, policy)
+		if err != nil {
+			respondWithPasswordError(w, err)
+			return
+		}
 	}
 
-	var u user
-	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&u)
+	// A new email stays pending and the old one keeps working until
+	// the new one is verified. Sending the current email cancels a change.
+	emailChanged := u.Email != "" && u.Email != p.User.Email
+	if emailChanged {
+		profileUpdate.PendingEmail = &u.Email
+	} else if u.Email != "" && p.User.PendingEmail != "" {
+		cancelled := ""
+		profileUpdate.PendingEmail = &cancelled
+	}
+
+	// One update, so nothing is applied when a part of it is rejected
+	_, err = database.UpdateUserProfile(id, profileUpdate)
+	if errors.Is(err, database.ErrHandleReserved) {
+		chirpsRespondWithJsonError(w, "Handle is reserved")
+		return
+	}
+	if errors.Is(err, database.ErrHandleTaken) {
+		respondWithJsonError(w, "Handle is already taken", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, database.ErrEmailTaken) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	user, err := database.UpdateUser(id, u.Email, u.Password)
+	if emailChanged {
+		err = sendEmailVerification(mailer, id, u.Email)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var user database.User
+	if passwordHash != "" {
+		user, err = database.SetUserPassword(id, passwordHash)
+	} else {
+		user, err = database.GetUser(id)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -110,6 +207,12 @@ func handleUsersPut(w http.ResponseWriter, r *http.Request, jwtSecret string) {
 	response := responseUser{
 		Id: user.Id,
 		Email: user.Email,
+		IsVerified: user.IsVerified,
+		PendingEmail: user.PendingEmail,
+		Handle: user.Handle,
+		DisplayName: user.DisplayName,
+		Bio: user.Bio,
+		AvatarUrl: user.AvatarUrl,
 	}
 
 	dat, err := json.Marshal(response)
@@ -122,15 +225,7 @@ func handleUsersPut(w http.ResponseWriter, r *http.Request, jwtSecret string) {
 }
 
 
-func handleLoginPost(w http.ResponseWriter, r *http.Request, jwtSecret string) {
-	type responseUser struct {
-		Id int `json:"id"`
-		Email string `json:"email"`
-		Token string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-		IsChirpyRed bool `json:"is_chirpy_red"`
-	}
-
+func handleLoginPost(w http.ResponseWriter, r *http.Request, jwtSecret string, guard *loginGuard, hasher *password.Hasher) {
 	var u user
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&u)
@@ -144,6 +239,13 @@ func handleLoginPost(w http.ResponseWriter, r *http.Request, jwtSecret string) {
 		return
 	}
 
+	ip := clientIp(r)
+	wait := guard.lockedFor(u.Email, ip)
+	if wait > 0 {
+		respondWithLoginLocked(w, wait)
+		return
+	}
+
 	db, err := database.GetDB()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -161,18 +263,62 @@ func handleLoginPost(w http.ResponseWriter, r *http.Request, jwtSecret string) {
 	}
 
 	if !ok {
+		// Same work as for a real account, so response times don't
+		// tell which emails are registered
+		hasher.DummyVerify(u.Password)
+		guard.fail(u.Email, ip)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
 	hashedPassword := userToAuth.Password
 
-	equal := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(u.Password))
-	if equal != nil {
+	equal, needsRehash, err := hasher.Verify(hashedPassword, u.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !equal {
+		guard.fail(u.Email, ip)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
+	// The plain password is only available here, so this is where hashes
+	// made with old parameters get upgraded
+	if needsRehash {
+		passwordHash, err := hasher.Hash(u.Password)
+		if err == nil {
+			_, err = database.RehashUserPassword(userToAuth.Id, hashedPassword, passwordHash)
+		}
+		// A concurrent password change wins over the rehash
+		if err != nil && !errors.Is(err, database.ErrPasswordChanged) {
+			fmt.Println("Error rehashing password:", err)
+		}
+	}
+
+	// With MFA the failures are only cleared after the second factor,
+	// so the password alone doesn't reset the lockout
+	if userToAuth.TotpEnabled {
+		respondWithMfaChallenge(w, userToAuth, jwtSecret)
+		return
+	}
+
+	guard.succeed(u.Email)
+	respondWithLoginTokens(w, r, userToAuth, jwtSecret)
+}
+
+// respondWithLoginTokens finishes a login, the refresh token is recorded
+// as a session of the user.
+func respondWithLoginTokens(w http.ResponseWriter, r *http.Request, userToAuth database.User, jwtSecret string) {
+	type responseUser struct {
+		Id int `json:"id"`
+		Email string `json:"email"`
+		Token string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		IsChirpyRed bool `json:"is_chirpy_red"`
+	}
+
 	token, err := createJWT(userToAuth.Id, jwtSecret, false)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -185,6 +331,18 @@ func handleLoginPost(w http.ResponseWriter, r *http.Request, jwtSecret string) {
 		return
 	}
 
+	_, err = database.SaveSession(
+		userToAuth.Id,
+		hashToken(refreshToken),
+		clientIp(r),
+		r.UserAgent(),
+		time.Now().UTC().Add(refreshTokenLifetime),
+	)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	response := responseUser{
 		Id: userToAuth.Id,
 		Email: userToAuth.Email,
@@ -3,10 +3,36 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
+const maxAttachmentUrlLength = 2048
+
+// validateChirpBody checks the body of a new or edited chirp against the
+// author's length limit and returns it cleaned up
+func validateChirpBody(body string, maxLength int) (string, error) {
+	if len(body) > maxLength {
+		return "", fmt.Errorf("Chirp is too long, the limit is %d characters", maxLength)
+	}
+	return cleanChirp(body), nil
+}
+
+func validateAttachments(attachments []string, maxAttachments int) error {
+	if len(attachments) > maxAttachments {
+		return fmt.Errorf("Too many attachments, the limit is %d", maxAttachments)
+	}
+	for _, attachment := range attachments {
+		parsed, err := url.Parse(attachment)
+		validScheme := err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
+		if !validScheme || parsed.Host == "" || len(attachment) > maxAttachmentUrlLength {
+			return errors.New("Attachments must be http or https URLs")
+		}
+	}
+	return nil
+}
 
 func cleanChirp(chirp string) string {
 	keywords := []string{"kerfuffle", "sharbert", "fornax"}
@@ -25,22 +51,41 @@ func cleanChirp(chirp string) string {
 	return result
 }
 
+var errRechirpWithContent = errors.New("Rechirps can't have a body, attachments, reply or quote")
+
 type chirp struct {
 	Chirp string `json:"body"`
+	InReplyTo int `json:"in_reply_to"`
+	RechirpOf int `json:"rechirp_of"`
+	QuoteOf int `json:"quote_of"`
+	Attachments []string `json:"attachments"`
 }
 
-func decodeChirp(r *http.Request) (string, error) {
+func decodeChirp(r *http.Request) (chirp, error) {
 	var c chirp
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&c)
 
 	if err != nil {
-		return "", err
+		return c, err
+	}
+
+	return c, c.validate()
+}
+
+func (c chirp) validate() error {
+	// Rechirps share another chirp as is, so they are the only ones
+	// without a body
+	if c.RechirpOf != 0 {
+		if c.Chirp != "" || len(c.Attachments) > 0 || c.InReplyTo != 0 || c.QuoteOf != 0 {
+			return errRechirpWithContent
+		}
+		return nil
 	}
 
 	if c.Chirp == "" {
-		return "", errors.New("Chirp is empty")
+		return errors.New("Chirp is empty")
 	}
 
-	return c.Chirp, nil
+	return nil
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+// chirpPolicy decides which chirps a viewer gets to see, every read path
+// goes through it. Anonymous viewers see everything.
+type chirpPolicy struct {
+	db database.Database
+	viewerId int
+}
+
+func newChirpPolicy(db database.Database, view chirpView) chirpPolicy {
+	return chirpPolicy{
+		db: db,
+		viewerId: view.viewerId,
+	}
+}
+
+// authors returns the users whose content chirp shows, a rechirp shows
+// the original author's
+func (p chirpPolicy) authors(chirp database.Chirp) []int {
+	authors := []int{chirp.AuthorId}
+	if chirp.RechirpOfId != 0 {
+		original, ok := p.db.Chirps[chirp.RechirpOfId]
+		if ok {
+			authors = append(authors, original.AuthorId)
+		}
+	}
+	return authors
+}
+
+// canSee is false for chirps by users who blocked the viewer
+func (p chirpPolicy) canSee(chirp database.Chirp) bool {
+	if p.viewerId == 0 {
+		return true
+	}
+	for _, authorId := range p.authors(chirp) {
+		if p.db.IsBlocked(authorId, p.viewerId) {
+			return false
+		}
+	}
+	return true
+}
+
+// inFeed is whether chirp belongs in the viewer's listings and search
+// results, which also leave out users the viewer muted
+func (p chirpPolicy) inFeed(chirp database.Chirp) bool {
+	if !p.canSee(chirp) {
+		return false
+	}
+	for _, authorId := range p.authors(chirp) {
+		if p.db.IsMuted(p.viewerId, authorId) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+const webhookEventChirpCreated = "chirp.created"
+const webhookEventChirpDeleted = "chirp.deleted"
+const webhookEventUserCreated = "user.created"
+const webhookEventMembershipChanged = "membership.changed"
+
+// outgoingWebhookEvents are the events endpoints can subscribe to
+var outgoingWebhookEvents = map[string]bool{
+	webhookEventChirpCreated: true,
+	webhookEventChirpDeleted: true,
+	webhookEventUserCreated: true,
+	webhookEventMembershipChanged: true,
+}
+
+const webhookEventHeader = "X-Chirpy-Event"
+const webhookDeliveryHeader = "X-Chirpy-Delivery"
+const webhookSignatureHeader = "X-Chirpy-Signature"
+const webhookTimestampHeader = "X-Chirpy-Timestamp"
+
+const webhookDispatchInterval = time.Second
+const webhookDeliveryTimeout = 10 * time.Second
+
+// Failed deliveries are retried after webhookRetryBase, doubling every
+// time up to webhookRetryMax, and dead lettered after maxWebhookFailures
+const webhookRetryBase = 30 * time.Second
+const webhookRetryMax = time.Hour
+const maxWebhookFailures = 8
+
+// webhookPayload is the body of every outgoing webhook
+type webhookPayload struct {
+	// Id identifies the event, it is the same for every endpoint and
+	// every attempt so receivers can drop duplicates
+	Id string `json:"id"`
+	Event string `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data any `json:"data"`
+}
+
+// deletedChirpEvent is the data of chirp.deleted events
+type deletedChirpEvent struct {
+	Id int `json:"id"`
+	AuthorId int `json:"author_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type webhookUser struct {
+	Id int `json:"id"`
+	IsChirpyRed bool `json:"is_chirpy_red"`
+	IsVerified bool `json:"is_verified"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type webhookMembership struct {
+	UserId int `json:"user_id"`
+	Tier string `json:"tier"`
+	Status string `json:"status"`
+	// Change is the event that changed the membership
+	Change string `json:"change"`
+	StartedAt time.Time `json:"started_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newWebhookMembership(membership database.Membership) webhookMembership {
+	change := ""
+	if len(membership.History) > 0 {
+		change = membership.History[len(membership.History)-1].Event
+	}
+	return webhookMembership{
+		UserId: membership.UserId,
+		Tier: membership.Tier,
+		Status: membership.Status,
+		Change: change,
+		StartedAt: membership.StartedAt,
+		ExpiresAt: membership.ExpiresAt,
+	}
+}
+
+// emitWebhookEvent queues an event for the endpoints subscribed to it. It
+// doesn't fail the request that caused the event, errors are only logged.
+func emitWebhookEvent(event string, data any) {
+	id, err := randomToken(16)
+	if err != nil {
+		fmt.Println("Error emitting webhook event:", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	payload, err := json.Marshal(webhookPayload{
+		Id: "evt_" + id,
+		Event: event,
+		CreatedAt: now,
+		Data: data,
+	})
+	if err != nil {
+		fmt.Println("Error emitting webhook event:", err)
+		return
+	}
+
+	_, err = database.QueueWebhookDeliveries("evt_"+id, event, string(payload), now)
+	if err != nil {
+		fmt.Println("Error emitting webhook event:", err)
+	}
+}
+
+// runWebhookDispatcher sends the due webhook deliveries every interval for
+// as long as the server runs.
+func runWebhookDispatcher(client *http.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		err := dispatchWebhooks(client, time.Now())
+		if err != nil {
+			fmt.Println("Error dispatching webhooks:", err)
+		}
+	}
+}
+
+// dispatchWebhooks sends the deliveries due by now concurrently and waits
+// for all of them, so none is picked up twice.
+func dispatchWebhooks(client *http.Client, now time.Time) error {
+	deliveries, endpoints, err := database.DueWebhookDeliveries(now)
+	if err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery database.WebhookDelivery, endpoint database.WebhookEndpoint) {
+			defer wg.Done()
+
+			attempt := sendWebhook(client, endpoint, delivery)
+			retryAt := time.Time{}
+			if delivery.Failures+1 < maxWebhookFailures {
+				retryAt = attempt.At.Add(webhookRetryDelay(delivery.Failures))
+			}
+			_, err := database.RecordWebhookDeliveryAttempt(delivery.Id, attempt, retryAt)
+			if err != nil {
+				fmt.Println("Error recording webhook delivery:", err)
+			}
+		}(delivery, endpoints[delivery.EndpointId])
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// webhookRetryDelay is how long to wait after a delivery failed for the
+// failures+1th time
+func webhookRetryDelay(failures int) time.Duration {
+	delay := webhookRetryBase
+	for i := 0; i < failures && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookRetryMax)
+}
+
+// sendWebhook makes one signed request for a delivery
+func sendWebhook(client *http.Client, endpoint database.WebhookEndpoint, delivery database.WebhookDelivery) database.WebhookDeliveryAttempt {
+	start := time.Now()
+	attempt := database.WebhookDeliveryAttempt{At: start}
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, endpoint.Url, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks")
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.Itoa(delivery.Id))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, webhookSignaturePrefix+webhookSignature(endpoint.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	return attempt
+}
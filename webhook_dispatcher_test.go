@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+// webhookReceiver is a local endpoint that records the requests it gets and
+// answers them with status
+type webhookReceiver struct {
+	mu sync.Mutex
+	status int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body []byte
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests = append(rec.requests, receivedWebhook{header: r.Header.Clone(), body: body})
+	w.WriteHeader(rec.status)
+}
+
+func (rec *webhookReceiver) received() []receivedWebhook {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]receivedWebhook{}, rec.requests...)
+}
+
+// useTempDB runs the test against an empty database in a temporary
+// directory, database.DbPath is relative to the working directory
+func useTempDB(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+}
+
+// setupWebhookEndpoint starts a receiver answering with status and
+// subscribes it to chirp.created
+func setupWebhookEndpoint(t *testing.T, status int) (*webhookReceiver, database.WebhookEndpoint) {
+	t.Helper()
+	useTempDB(t)
+
+	receiver := &webhookReceiver{status: status}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	endpoint, err := database.CreateWebhookEndpoint(server.URL, []string{webhookEventChirpCreated}, "testsecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receiver, endpoint
+}
+
+// onlyDelivery returns the single delivery in the database
+func onlyDelivery(t *testing.T) database.WebhookDelivery {
+	t.Helper()
+	db, err := database.GetDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.WebhookDeliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(db.WebhookDeliveries))
+	}
+	for _, delivery := range db.WebhookDeliveries {
+		return delivery
+	}
+	return database.WebhookDelivery{}
+}
+
+func TestDispatchWebhooksDeliversSignedRequest(t *testing.T) {
+	receiver, endpoint := setupWebhookEndpoint(t, http.StatusNoContent)
+	client := &http.Client{Timeout: webhookDeliveryTimeout}
+
+	emitWebhookEvent(webhookEventChirpCreated, map[string]int{"id": 7})
+	// Not subscribed to, nothing is queued
+	emitWebhookEvent(webhookEventUserCreated, map[string]int{"id": 1})
+
+	err := dispatchWebhooks(client, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := receiver.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	request := requests[0]
+	delivery := onlyDelivery(t)
+
+	if got := request.header.Get(webhookEventHeader); got != webhookEventChirpCreated {
+		t.Errorf("event header is %q, want %q", got, webhookEventChirpCreated)
+	}
+	if got := request.header.Get(webhookDeliveryHeader); got != strconv.Itoa(delivery.Id) {
+		t.Errorf("delivery header is %q, want %d", got, delivery.Id)
+	}
+	timestamp := request.header.Get(webhookTimestampHeader)
+	expected := webhookSignaturePrefix + webhookSignature(endpoint.Secret, timestamp, request.body)
+	if got := request.header.Get(webhookSignatureHeader); got != expected {
+		t.Errorf("signature header is %q, want %q", got, expected)
+	}
+
+	var payload struct {
+		Id string `json:"id"`
+		Event string `json:"event"`
+		Data struct {
+			Id int `json:"id"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(request.body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Id != delivery.EventId || payload.Event != webhookEventChirpCreated || payload.Data.Id != 7 {
+		t.Errorf("unexpected payload %s", request.body)
+	}
+
+	if delivery.Status != database.WebhookDeliveryDelivered {
+		t.Errorf("status is %q, want %q", delivery.Status, database.WebhookDeliveryDelivered)
+	}
+	if delivery.DeliveredAt == nil || delivery.NextAttemptAt != nil {
+		t.Errorf("delivered delivery has delivered_at %v and next_attempt_at %v", delivery.DeliveredAt, delivery.NextAttemptAt)
+	}
+	if len(delivery.Attempts) != 1 || delivery.Attempts[0].StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected attempts %+v", delivery.Attempts)
+	}
+}
+
+func TestDispatchWebhooksSchedulesRetries(t *testing.T) {
+	receiver, _ := setupWebhookEndpoint(t, http.StatusInternalServerError)
+	client := &http.Client{Timeout: webhookDeliveryTimeout}
+
+	emitWebhookEvent(webhookEventChirpCreated, map[string]int{"id": 7})
+
+	err := dispatchWebhooks(client, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := onlyDelivery(t)
+	if delivery.Status != database.WebhookDeliveryPending || delivery.Failures != 1 {
+		t.Fatalf("got status %q with %d failures, want pending with 1", delivery.Status, delivery.Failures)
+	}
+	retryAt := delivery.Attempts[0].At.Add(webhookRetryBase)
+	if delivery.NextAttemptAt == nil || !delivery.NextAttemptAt.Equal(retryAt) {
+		t.Fatalf("next attempt at %v, want %v", delivery.NextAttemptAt, retryAt)
+	}
+
+	// Not due yet
+	err = dispatchWebhooks(client, retryAt.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(receiver.received()); got != 1 {
+		t.Fatalf("got %d requests before the retry was due, want 1", got)
+	}
+
+	err = dispatchWebhooks(client, retryAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(receiver.received()); got != 2 {
+		t.Fatalf("got %d requests after the retry was due, want 2", got)
+	}
+	delivery = onlyDelivery(t)
+	retryAt = delivery.Attempts[1].At.Add(2 * webhookRetryBase)
+	if delivery.Failures != 2 || delivery.NextAttemptAt == nil || !delivery.NextAttemptAt.Equal(retryAt) {
+		t.Fatalf("got %d failures and next attempt at %v, want 2 and %v", delivery.Failures, delivery.NextAttemptAt, retryAt)
+	}
+}
+
+func TestDispatchWebhooksDeadLetters(t *testing.T) {
+	receiver, _ := setupWebhookEndpoint(t, http.StatusBadGateway)
+	client := &http.Client{Timeout: webhookDeliveryTimeout}
+
+	emitWebhookEvent(webhookEventChirpCreated, map[string]int{"id": 7})
+
+	now := time.Now()
+	for i := 0; i < maxWebhookFailures; i++ {
+		err := dispatchWebhooks(client, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delivery := onlyDelivery(t)
+		if delivery.NextAttemptAt != nil {
+			now = *delivery.NextAttemptAt
+		}
+	}
+
+	delivery := onlyDelivery(t)
+	if delivery.Status != database.WebhookDeliveryDead {
+		t.Fatalf("status is %q, want %q", delivery.Status, database.WebhookDeliveryDead)
+	}
+	if delivery.Failures != maxWebhookFailures || delivery.NextAttemptAt != nil {
+		t.Fatalf("got %d failures and next attempt at %v, want %d and none", delivery.Failures, delivery.NextAttemptAt, maxWebhookFailures)
+	}
+
+	// Dead deliveries are not picked up again
+	err := dispatchWebhooks(client, now.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(receiver.received()); got != maxWebhookFailures {
+		t.Fatalf("got %d requests, want %d", got, maxWebhookFailures)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want time.Duration
+	}{
+		{0, webhookRetryBase},
+		{1, 2 * webhookRetryBase},
+		{3, 8 * webhookRetryBase},
+		{7, webhookRetryMax},
+		{100, webhookRetryMax},
+	}
+	for _, test := range tests {
+		if got := webhookRetryDelay(test.failures); got != test.want {
+			t.Errorf("webhookRetryDelay(%d) = %v, want %v", test.failures, got, test.want)
+		}
+	}
+}
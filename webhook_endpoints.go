@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+// webhookDeliveriesOrder is the only order deliveries are listed in
+const webhookDeliveriesOrder = "id:desc"
+
+type responseWebhookEndpoint struct {
+	database.WebhookEndpoint
+	// Secret is only shown when the endpoint is created
+	Secret string `json:"secret,omitempty"`
+}
+
+func newResponseWebhookEndpoint(endpoint database.WebhookEndpoint) responseWebhookEndpoint {
+	return responseWebhookEndpoint{WebhookEndpoint: endpoint}
+}
+
+type requestWebhookEndpoint struct {
+	Url *string `json:"url"`
+	Events []string `json:"events"`
+	Active *bool `json:"active"`
+}
+
+func validateWebhookUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+func validateWebhookEvents(events []string) error {
+	if len(events) == 0 {
+		return errors.New("events must name at least one event")
+	}
+	for _, event := range events {
+		if !outgoingWebhookEvents[event] {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+func parseWebhookEndpointId(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func respondWithWebhookEndpoint(w http.ResponseWriter, endpoint responseWebhookEndpoint, status int) {
+	dat, err := json.Marshal(endpoint)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, status)
+}
+
+// handleAdminWebhookEndpointsPost registers an endpoint and hands out the
+// secret its deliveries are signed with
+func handleAdminWebhookEndpointsPost(w http.ResponseWriter, r *http.Request) {
+	var body requestWebhookEndpoint
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if body.Url == nil {
+		chirpsRespondWithJsonError(w, "url is required")
+		return
+	}
+	err = validateWebhookUrl(*body.Url)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	err = validateWebhookEvents(body.Events)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	endpoint, err := database.CreateWebhookEndpoint(*body.Url, body.Events, "whsec_"+secret)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if body.Active != nil && !*body.Active {
+		endpoint, err = database.UpdateWebhookEndpoint(endpoint.Id, database.WebhookEndpointUpdate{Active: body.Active})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := newResponseWebhookEndpoint(endpoint)
+	response.Secret = endpoint.Secret
+	respondWithWebhookEndpoint(w, response, http.StatusCreated)
+}
+
+func handleAdminWebhookEndpointsGet(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	endpoints := []responseWebhookEndpoint{}
+	for _, endpoint := range db.WebhookEndpoints {
+		endpoints = append(endpoints, newResponseWebhookEndpoint(endpoint))
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Id < endpoints[j].Id
+	})
+
+	dat, err := json.Marshal(endpoints)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+func handleAdminWebhookEndpointsGetId(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseWebhookEndpointId(w, r)
+	if !ok {
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	endpoint, ok := db.WebhookEndpoints[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	respondWithWebhookEndpoint(w, newResponseWebhookEndpoint(endpoint), http.StatusOK)
+}
+
+// handleAdminWebhookEndpointsPatch changes the URL, the events or whether
+// the endpoint is active. Inactive endpoints get no new deliveries.
+func handleAdminWebhookEndpointsPatch(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseWebhookEndpointId(w, r)
+	if !ok {
+		return
+	}
+
+	var body requestWebhookEndpoint
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if body.Url != nil {
+		err = validateWebhookUrl(*body.Url)
+		if err != nil {
+			chirpsRespondWithJsonError(w, err.Error())
+			return
+		}
+	}
+	if body.Events != nil {
+		err = validateWebhookEvents(body.Events)
+		if err != nil {
+			chirpsRespondWithJsonError(w, err.Error())
+			return
+		}
+	}
+
+	endpoint, err := database.UpdateWebhookEndpoint(id, database.WebhookEndpointUpdate{
+		Url: body.Url,
+		Events: body.Events,
+		Active: body.Active,
+	})
+	if errors.Is(err, database.ErrWebhookEndpointNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithWebhookEndpoint(w, newResponseWebhookEndpoint(endpoint), http.StatusOK)
+}
+
+func handleAdminWebhookEndpointsDelete(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseWebhookEndpointId(w, r)
+	if !ok {
+		return
+	}
+
+	err := database.DeleteWebhookEndpoint(id)
+	if errors.Is(err, database.ErrWebhookEndpointNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminWebhookDeliveriesGet lists outgoing deliveries, newest first,
+// optionally only those of one endpoint, event or status
+func handleAdminWebhookDeliveriesGet(w http.ResponseWriter, r *http.Request) {
+	type responseWebhookDeliveries struct {
+		Deliveries []database.WebhookDelivery `json:"deliveries"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	if page.cursor != nil && page.cursor.Order != webhookDeliveriesOrder {
+		chirpsRespondWithJsonError(w, "cursor was made for a different sort")
+		return
+	}
+
+	query := r.URL.Query()
+	endpointId := 0
+	if raw := query.Get("endpoint_id"); raw != "" {
+		endpointId, err = strconv.Atoi(raw)
+		if err != nil {
+			chirpsRespondWithJsonError(w, "endpoint_id must be an integer")
+			return
+		}
+	}
+	event := query.Get("event")
+	status := query.Get("status")
+
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	deliveries := []database.WebhookDelivery{}
+	for _, delivery := range db.WebhookDeliveries {
+		if page.cursor != nil && delivery.Id >= page.cursor.Id {
+			continue
+		}
+		if page.sinceId != 0 && delivery.Id <= page.sinceId {
+			continue
+		}
+		if page.maxId != 0 && delivery.Id > page.maxId {
+			continue
+		}
+		if endpointId != 0 && delivery.EndpointId != endpointId {
+			continue
+		}
+		if event != "" && delivery.Event != event {
+			continue
+		}
+		if status != "" && delivery.Status != status {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Id > deliveries[j].Id
+	})
+
+	nextCursor := ""
+	if len(deliveries) > page.limit {
+		deliveries = deliveries[:page.limit]
+		nextCursor = encodeCursor(pageCursor{
+			Order: webhookDeliveriesOrder,
+			Id: deliveries[len(deliveries)-1].Id,
+		})
+		setNextLinkHeader(w, r, nextCursor)
+	}
+
+	dat, err := json.Marshal(responseWebhookDeliveries{
+		Deliveries: deliveries,
+		NextCursor: nextCursor,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+func handleAdminWebhookDeliveriesGetId(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	delivery, ok := db.WebhookDeliveries[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	dat, err := json.Marshal(delivery)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+// handleAdminWebhookDeliveriesRetryPost queues a delivery, usually a dead
+// lettered one, to be sent again on the next dispatch
+func handleAdminWebhookDeliveriesRetryPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := database.RequeueWebhookDelivery(id, time.Now())
+	if errors.Is(err, database.ErrWebhookDeliveryNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrWebhookEndpointNotFound) {
+		respondWithJsonError(w, "The endpoint of the delivery was deleted", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	dat, err := json.Marshal(delivery)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusAccepted)
+}
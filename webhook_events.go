@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/daniilgaltsev/chirpylike/internal/database"
+)
+
+// webhookEventsOrder is the only order webhook events are listed in
+const webhookEventsOrder = "id:desc"
+
+type webhookEventFilter struct {
+	source string
+	eventType string
+	eventId string
+	outcome string
+	userId int
+	verified *bool
+	since time.Time
+	until time.Time
+}
+
+func parseWebhookEventFilter(r *http.Request) (webhookEventFilter, error) {
+	query := r.URL.Query()
+	filter := webhookEventFilter{
+		source: query.Get("source"),
+		eventType: query.Get("event"),
+		eventId: query.Get("event_id"),
+		outcome: query.Get("outcome"),
+	}
+
+	if raw := query.Get("user_id"); raw != "" {
+		userId, err := strconv.Atoi(raw)
+		if err != nil {
+			return filter, errors.New("user_id must be an integer")
+		}
+		filter.userId = userId
+	}
+	if raw := query.Get("verified"); raw != "" {
+		verified, err := strconv.ParseBool(raw)
+		if err != nil {
+			return filter, errors.New("verified must be true or false")
+		}
+		filter.verified = &verified
+	}
+
+	var err error
+	filter.since, err = parseTimeParam("since", query.Get("since"))
+	if err != nil {
+		return filter, err
+	}
+	filter.until, err = parseTimeParam("until", query.Get("until"))
+	if err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+func (f webhookEventFilter) matches(event database.WebhookEvent) bool {
+	if f.source != "" && event.Source != f.source {
+		return false
+	}
+	if f.eventType != "" && event.EventType != f.eventType {
+		return false
+	}
+	if f.eventId != "" && event.EventId != f.eventId {
+		return false
+	}
+	if f.outcome != "" && event.Outcome != f.outcome {
+		return false
+	}
+	if f.userId != 0 && event.UserId != f.userId {
+		return false
+	}
+	if f.verified != nil && event.Verified != *f.verified {
+		return false
+	}
+	if !f.since.IsZero() && event.ReceivedAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !event.ReceivedAt.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// handleAdminWebhooksGet lists received webhooks, newest first
+func handleAdminWebhooksGet(w http.ResponseWriter, r *http.Request) {
+	type responseWebhookEvents struct {
+		Events []database.WebhookEvent `json:"events"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+	if page.cursor != nil && page.cursor.Order != webhookEventsOrder {
+		chirpsRespondWithJsonError(w, "cursor was made for a different sort")
+		return
+	}
+	filter, err := parseWebhookEventFilter(r)
+	if err != nil {
+		chirpsRespondWithJsonError(w, err.Error())
+		return
+	}
+
+	db, err := database.GetDB()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events := []database.WebhookEvent{}
+	for _, event := range db.WebhookEvents {
+		if page.cursor != nil && event.Id >= page.cursor.Id {
+			continue
+		}
+		if page.sinceId != 0 && event.Id <= page.sinceId {
+			continue
+		}
+		if page.maxId != 0 && event.Id > page.maxId {
+			continue
+		}
+		if filter.matches(event) {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Id > events[j].Id
+	})
+
+	nextCursor := ""
+	if len(events) > page.limit {
+		events = events[:page.limit]
+		nextCursor = encodeCursor(pageCursor{
+			Order: webhookEventsOrder,
+			Id: events[len(events)-1].Id,
+		})
+		setNextLinkHeader(w, r, nextCursor)
+	}
+
+	dat, err := json.Marshal(responseWebhookEvents{
+		Events: events,
+		NextCursor: nextCursor,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+func handleAdminWebhooksGetId(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	event, err := database.GetWebhookEvent(id)
+	if errors.Is(err, database.ErrWebhookEventNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	dat, err := json.Marshal(event)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
+
+// handleAdminWebhooksReplayPost processes a stored webhook again and
+// records the attempt. Events that failed verification are never replayed,
+// and events already applied are only acknowledged, as with redeliveries.
+func handleAdminWebhooksReplayPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	event, err := database.GetWebhookEvent(id)
+	if errors.Is(err, database.ErrWebhookEventNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !event.Verified {
+		respondWithJsonError(w, "Only verified webhooks can be replayed", http.StatusConflict)
+		return
+	}
+
+	attempt := database.WebhookAttempt{Replay: true}
+	switch event.Source {
+	case database.WebhookSourcePolka:
+		var processErr error
+		attempt.Outcome, _, processErr = processPolkaEvent([]byte(event.Body))
+		if processErr != nil {
+			attempt.Error = processErr.Error()
+		}
+	default:
+		respondWithJsonError(w, "Webhooks from "+event.Source+" can't be replayed", http.StatusConflict)
+		return
+	}
+	attempt.At = time.Now()
+
+	event, err = database.RecordWebhookAttempt(event.Id, attempt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	dat, err := json.Marshal(event)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJson(w, dat, http.StatusOK)
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daniilgaltsev/chirpylike/internal/pubsub"
+	"github.com/daniilgaltsev/chirpylike/internal/websocket"
+)
+
+// Channels clients can subscribe to. feed has every chirp event, user:<id>
+// those of one author and notifications those for the authenticated user.
+// Authenticated clients don't get the chirps their listings leave out.
+const wsChannelFeed = "feed"
+const wsChannelUserPrefix = "user:"
+const wsChannelNotifications = "notifications"
+
+const wsMaxMessageBytes = 16 << 10
+const wsMaxSubscriptions = 16
+// wsSendQueueSize is how many messages may wait for a client before it is
+// disconnected as too slow
+const wsSendQueueSize = 64
+
+// A ping is sent every wsPingInterval, connections without a pong for
+// wsPongWait are closed
+const wsPingInterval = 30 * time.Second
+const wsPongWait = 60 * time.Second
+const wsWriteTimeout = 10 * time.Second
+
+// wsCredentialsCheckInterval is how often the credentials of authenticated
+// connections are checked again, so revoked ones stop working
+const wsCredentialsCheckInterval = 30 * time.Second
+
+// Clients may send wsMessageBurst messages at once and wsMessagesPerSecond
+// on average
+const wsMessagesPerSecond = 5
+const wsMessageBurst = 20
+
+// wsRequest is a message from a client. Id is echoed in the reply.
+type wsRequest struct {
+	Type string `json:"type"`
+	Id string `json:"id,omitempty"`
+	// Token authenticates auth requests, like the Authorization header
+	Token string `json:"token,omitempty"`
+	// Channel is for subscribe and unsubscribe requests
+	Channel string `json:"channel,omitempty"`
+	// Chirp is for chirp requests, in the body of POST /api/chirps
+	Chirp *chirp `json:"chirp,omitempty"`
+}
+
+type wsReply struct {
+	Type string `json:"type"`
+	Id string `json:"id,omitempty"`
+	Ok bool `json:"ok"`
+	Status int `json:"status,omitempty"`
+	Error string `json:"error,omitempty"`
+	// RetryAfter is in seconds, sent with status 429
+	RetryAfter int `json:"retry_after,omitempty"`
+	Data any `json:"data,omitempty"`
+}
+
+type wsEvent struct {
+	Type string `json:"type"`
+	Channel string `json:"channel"`
+	Event string `json:"event"`
+	Data json.RawMessage `json:"data"`
+}
+
+type wsWelcome struct {
+	Type string `json:"type"`
+	// UserId is zero until the client authenticates
+	UserId int `json:"user_id,omitempty"`
+}
+
+// wsRateLimiter is a token bucket over the messages of one connection
+type wsRateLimiter struct {
+	tokens float64
+	last time.Time
+}
+
+func (l *wsRateLimiter) allow(now time.Time) bool {
+	if l.last.IsZero() {
+		l.tokens = wsMessageBurst
+	} else {
+		l.tokens = min(wsMessageBurst, l.tokens+now.Sub(l.last).Seconds()*wsMessagesPerSecond)
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+type wsClient struct {
+	cfg *apiConfig
+	conn *websocket.Conn
+	principal principal
+	// authorization is the Authorization header value the client
+	// authenticated with, kept to check it again
+	authorization string
+	authenticated bool
+	// viewerId is the authenticated user for the goroutines forwarding
+	// events, zero before the client authenticates
+	viewerId atomic.Int64
+	limiter wsRateLimiter
+	// subscriptions map channels to their unsubscribe functions, they are
+	// only used by the reading goroutine
+	subscriptions map[string]func()
+
+	send chan []byte
+	// done is closed when the connection is to be closed with closeCode
+	done chan struct{}
+	closeOnce sync.Once
+	closeCode int
+	closeReason string
+}
+
+// wsError is a failed request, answered with status and message
+type wsError struct {
+	status int
+	message string
+}
+
+// handleWs serves the WebSocket API. Clients authenticate with the
+// Authorization header of the handshake or an auth message, subscribe to
+// channels to get live events and can post chirps. The connection is
+// closed once the credentials expire or are revoked.
+func (cfg *apiConfig) handleWs(w http.ResponseWriter, r *http.Request) {
+	client := &wsClient{
+		cfg: cfg,
+		subscriptions: map[string]func(){},
+		send: make(chan []byte, wsSendQueueSize),
+		done: make(chan struct{}),
+	}
+	p, authenticated := principalFromContext(r.Context())
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	if authenticated {
+		client.authenticate(p, r.Header.Get("Authorization"))
+	}
+	client.conn = conn
+	conn.SetReadLimit(wsMaxMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(data []byte) {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	writerDone := make(chan struct{})
+	go client.writeLoop(writerDone)
+
+	client.enqueue(wsWelcome{Type: "welcome", UserId: client.principal.User.Id})
+	client.readLoop()
+
+	client.shutdown(websocket.CloseNormal, "")
+	for _, unsubscribe := range client.subscriptions {
+		unsubscribe()
+	}
+	<-writerDone
+}
+
+// shutdown makes the writer close the connection, the first code wins
+func (c *wsClient) shutdown(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// enqueue queues a message for the writer without blocking. Clients that
+// don't keep up are disconnected.
+func (c *wsClient) enqueue(message any) {
+	dat, err := json.Marshal(message)
+	if err != nil {
+		fmt.Println("Error encoding WebSocket message:", err)
+		return
+	}
+
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	select {
+	case c.send <- dat:
+	default:
+		c.shutdown(websocket.ClosePolicyViolation, "client too slow")
+	}
+}
+
+func (c *wsClient) writeLoop(done chan struct{}) {
+	defer close(done)
+	defer c.conn.Close()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case dat := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err = c.conn.WriteMessage(websocket.TextMessage, dat)
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err = c.conn.WritePing(nil)
+		case <-c.done:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			c.conn.WriteClose(c.closeCode, c.closeReason)
+			return
+		}
+		if err != nil {
+			c.shutdown(websocket.CloseGoingAway, "")
+			return
+		}
+	}
+}
+
+func (c *wsClient) readLoop() {
+	for {
+		messageType, dat, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			c.shutdown(websocket.CloseUnsupportedData, "only JSON text messages are supported")
+			return
+		}
+
+		var request wsRequest
+		err = json.Unmarshal(dat, &request)
+		if !c.limiter.allow(time.Now()) {
+			c.replyError(request, &wsError{status: http.StatusTooManyRequests, message: "Too many messages, slow down"})
+			continue
+		}
+		if err != nil {
+			c.replyError(request, &wsError{status: http.StatusBadRequest, message: "Message is not valid JSON"})
+			continue
+		}
+
+		c.handle(request)
+	}
+}
+
+func (c *wsClient) reply(request wsRequest, data any) {
+	c.enqueue(wsReply{
+		Type: "reply",
+		Id: request.Id,
+		Ok: true,
+		Data: data,
+	})
+}
+
+func (c *wsClient) replyError(request wsRequest, err *wsError) {
+	c.enqueue(wsReply{
+		Type: "reply",
+		Id: request.Id,
+		Status: err.status,
+		Error: err.message,
+	})
+}
+
+func (c *wsClient) handle(request wsRequest) {
+	switch request.Type {
+	case "auth":
+		c.handleAuth(request)
+	case "subscribe":
+		wsErr := c.subscribe(request.Channel)
+		if wsErr != nil {
+			c.replyError(request, wsErr)
+			return
+		}
+		c.reply(request, nil)
+	case "unsubscribe":
+		if unsubscribe, ok := c.subscriptions[request.Channel]; ok {
+			unsubscribe()
+			delete(c.subscriptions, request.Channel)
+		}
+		c.reply(request, nil)
+	case "chirp":
+		c.handleChirp(request)
+	default:
+		c.replyError(request, &wsError{status: http.StatusBadRequest, message: "Unknown message type"})
+	}
+}
+
+func (c *wsClient) handleAuth(request wsRequest) {
+	if c.authenticated {
+		c.replyError(request, &wsError{status: http.StatusBadRequest, message: "Already authenticated"})
+		return
+	}
+	if request.Token == "" {
+		c.replyError(request, &wsError{status: http.StatusBadRequest, message: "token is required"})
+		return
+	}
+
+	p, err := authenticateAuthorization("Bearer "+request.Token, c.cfg.jwtSecret)
+	if errors.Is(err, errUnauthorized) {
+		c.replyError(request, &wsError{status: http.StatusUnauthorized, message: "Invalid token"})
+		return
+	}
+	if err != nil {
+		c.replyError(request, &wsError{status: http.StatusInternalServerError, message: "Something went wrong"})
+		return
+	}
+
+	c.authenticate(p, "Bearer "+request.Token)
+	c.reply(request, wsWelcome{Type: "authenticated", UserId: p.User.Id})
+}
+
+func (c *wsClient) authenticate(p principal, authorization string) {
+	c.principal = p
+	c.authorization = authorization
+	c.authenticated = true
+	c.viewerId.Store(int64(p.User.Id))
+	go c.watchCredentials(authorization, p.ExpiresAt)
+}
+
+// watchCredentials closes the connection when the credentials expire, or
+// when a periodic check finds them revoked
+func (c *wsClient) watchCredentials(authorization string, expiresAt time.Time) {
+	check := time.NewTicker(wsCredentialsCheckInterval)
+	defer check.Stop()
+
+	var expired <-chan time.Time
+	if !expiresAt.IsZero() {
+		timer := time.NewTimer(time.Until(expiresAt))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-expired:
+			c.shutdown(websocket.ClosePolicyViolation, "credentials expired")
+			return
+		case <-check.C:
+			_, err := authenticateAuthorization(authorization, c.cfg.jwtSecret)
+			if errors.Is(err, errUnauthorized) {
+				c.shutdown(websocket.ClosePolicyViolation, "credentials no longer valid")
+				return
+			}
+			if err != nil {
+				fmt.Println("Error checking WebSocket credentials:", err)
+			}
+		}
+	}
+}
+
+// forward passes the messages of a subscription accepted by allow to the
+// client as events on channel until it is unsubscribed or the connection
+// closes. A nil allow accepts everything.
+func forward[T any](c *wsClient, sub *pubsub.Subscription[T], channel string, allow func(T) bool, toEvent func(T) (string, json.RawMessage)) func() {
+	go func() {
+		for {
+			select {
+			case message, ok := <-sub.C():
+				if !ok {
+					if errors.Is(sub.Err(), pubsub.ErrSlowConsumer) {
+						c.shutdown(websocket.ClosePolicyViolation, "client too slow")
+					}
+					return
+				}
+				if allow != nil && !allow(message.Value) {
+					continue
+				}
+				event, data := toEvent(message.Value)
+				c.enqueue(wsEvent{
+					Type: "event",
+					Channel: channel,
+					Event: event,
+					Data: data,
+				})
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return sub.Close
+}
+
+// inFeed leaves out chirp events the viewer's blocks and mutes hide, the
+// publisher has already worked out for whom.
+func (c *wsClient) inFeed(event streamEvent) bool {
+	viewerId := int(c.viewerId.Load())
+	return viewerId == 0 || !event.HiddenFrom[viewerId]
+}
+
+func streamEventData(event streamEvent) (string, json.RawMessage) {
+	return event.Type, event.Data
+}
+
+func notificationEventData(event notificationEvent) (string, json.RawMessage) {
+	return "notification", event.Data
+}
+
+func (c *wsClient) subscribe(channel string) *wsError {
+	if _, ok := c.subscriptions[channel]; ok {
+		return nil
+	}
+	if len(c.subscriptions) >= wsMaxSubscriptions {
+		return &wsError{status: http.StatusBadRequest, message: "Too many subscriptions"}
+	}
+
+	switch {
+	case channel == wsChannelFeed:
+		sub := c.cfg.chirpEvents.Subscribe(0, nil)
+		c.subscriptions[channel] = forward(c, sub, channel, c.inFeed, streamEventData)
+	case strings.HasPrefix(channel, wsChannelUserPrefix):
+		authorId, err := strconv.Atoi(strings.TrimPrefix(channel, wsChannelUserPrefix))
+		if err != nil {
+			return &wsError{status: http.StatusBadRequest, message: "User channels are user:<id>"}
+		}
+		sub := c.cfg.chirpEvents.Subscribe(0, func(event streamEvent) bool {
+			return event.AuthorId == authorId
+		})
+		c.subscriptions[channel] = forward(c, sub, channel, c.inFeed, streamEventData)
+	case channel == wsChannelNotifications:
+		if !c.authenticated {
+			return &wsError{status: http.StatusUnauthorized, message: "Notifications need authentication"}
+		}
+		if !c.principal.hasScope(scopeChirpsRead) {
+			return &wsError{status: http.StatusForbidden, message: "Token lacks the " + scopeChirpsRead + " scope"}
+		}
+		userId := c.principal.User.Id
+		sub := c.cfg.notifications.Subscribe(0, func(event notificationEvent) bool {
+			return event.RecipientId == userId
+		})
+		c.subscriptions[channel] = forward(c, sub, channel, nil, notificationEventData)
+	default:
+		return &wsError{status: http.StatusBadRequest, message: "Unknown channel"}
+	}
+	return nil
+}
+
+// handleChirp posts a chirp like POST /api/chirps and replies with it
+func (c *wsClient) handleChirp(request wsRequest) {
+	if !c.authenticated {
+		c.replyError(request, &wsError{status: http.StatusUnauthorized, message: "Posting needs authentication"})
+		return
+	}
+	if !c.principal.hasScope(scopeChirpsWrite) {
+		c.replyError(request, &wsError{status: http.StatusForbidden, message: "Token lacks the " + scopeChirpsWrite + " scope"})
+		return
+	}
+	if request.Chirp == nil {
+		c.replyError(request, &wsError{status: http.StatusBadRequest, message: "chirp is required"})
+		return
+	}
+	err := request.Chirp.validate()
+	if err != nil {
+		c.replyError(request, &wsError{status: http.StatusBadRequest, message: err.Error()})
+		return
+	}
+
+	// The credentials may have been revoked and the user changed since the
+	// connection was authenticated
+	p, err := authenticateAuthorization(c.authorization, c.cfg.jwtSecret)
+	if errors.Is(err, errUnauthorized) {
+		c.shutdown(websocket.ClosePolicyViolation, "credentials no longer valid")
+		return
+	}
+	if err != nil {
+		c.replyError(request, &wsError{status: http.StatusInternalServerError, message: "Something went wrong"})
+		return
+	}
+	author := p.User
+
+	chirp, db, err := c.cfg.createChirp(author, *request.Chirp)
+	var postErr *chirpPostError
+	if errors.As(err, &postErr) {
+		c.enqueue(wsReply{
+			Type: "reply",
+			Id: request.Id,
+			Status: postErr.status,
+			Error: postErr.message,
+			RetryAfter: int(math.Ceil(postErr.retryAfter.Seconds())),
+		})
+		return
+	}
+	if err != nil {
+		c.replyError(request, &wsError{status: http.StatusInternalServerError, message: "Something went wrong"})
+		return
+	}
+
+	c.reply(request, newResponseChirp(db, chirp, chirpView{viewerId: author.Id}))
+}